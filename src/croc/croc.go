@@ -7,6 +7,7 @@ import (
 	"encoding/binary"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"math"
@@ -377,6 +378,9 @@ func GetFilesInfo(fnames []string, zipfolder bool, ignoreGit bool, exclusions []
 			}
 		}
 	}
+	// the zipped folders are marked for removal together once done
+	var zipped []string
+	defer func() { utils.MarkFilesForRemoval(zipped...) }()
 	for _, fpath := range paths {
 		stat, errStat := os.Lstat(fpath)
 
@@ -397,8 +401,12 @@ func GetFilesInfo(fnames []string, zipfolder bool, ignoreGit bool, exclusions []
 			}
 			fpath = filepath.Dir(fpath)
 			dest := filepath.Base(fpath) + ".zip"
-			utils.ZipDirectory(dest, fpath)
-			utils.MarkFileForRemoval(dest)
+			if err = utils.ZipDirectory(dest, fpath); err != nil {
+				os.Remove(dest)
+				err = fmt.Errorf("could not zip %s: %w", fpath, err)
+				return
+			}
+			zipped = append(zipped, dest)
 			stat, errStat = os.Lstat(dest)
 			if errStat != nil {
 				err = errStat
@@ -1137,10 +1145,17 @@ func (c *Client) transfer() (err error) {
 		}
 	}
 
+	// kept apart so that the cleanup below doesn't clear it
+	var unzipErr error
 	if c.SuccessfulTransfer && !c.Options.IsSender {
 		for _, file := range c.FilesToTransfer {
 			if file.TempFile {
-				utils.UnzipDirectory(".", file.Name)
+				if errUnzip := utils.UnzipDirectory(".", file.Name); errUnzip != nil {
+					errUnzip = fmt.Errorf("could not unzip %s: %w", file.Name, errUnzip)
+					log.Error(errUnzip)
+					unzipErr = errors.Join(unzipErr, errUnzip)
+					continue
+				}
 				os.Remove(file.Name)
 				log.Debugf("Removing %s\n", file.Name)
 			}
@@ -1163,6 +1178,9 @@ func (c *Client) transfer() (err error) {
 		}
 		fmt.Fprint(os.Stderr, "\n")
 	}
+	if unzipErr != nil {
+		err = errors.Join(err, unzipErr)
+	}
 	if err != nil && strings.Contains(err.Error(), "pake not successful") {
 		log.Debugf("pake error: %s", err.Error())
 		err = fmt.Errorf("password mismatch")
@@ -1513,6 +1531,14 @@ func (c *Client) processMessage(payload []byte) (done bool, err error) {
 		if err != nil {
 			return
 		}
+		if remoteFile.FilesToTransferCurrentNum < 0 || remoteFile.FilesToTransferCurrentNum >= len(c.FilesToTransfer) {
+			err = fmt.Errorf("invalid file number %d", remoteFile.FilesToTransferCurrentNum)
+			return
+		}
+		fileSize := c.FilesToTransfer[remoteFile.FilesToTransferCurrentNum].Size
+		if err = utils.ValidateChunkRanges(remoteFile.CurrentFileChunkRanges, fileSize); err != nil {
+			return
+		}
 		c.FilesToTransferCurrentNum = remoteFile.FilesToTransferCurrentNum
 		c.CurrentFileChunkRanges = remoteFile.CurrentFileChunkRanges
 		c.CurrentFileChunks = utils.ChunkRangesToChunks(c.CurrentFileChunkRanges)
@@ -1642,9 +1668,9 @@ func (c *Client) recipientInitializeFile() (err error) {
 		truncate = true
 	}
 	if truncate {
-		err := c.CurrentFile.Truncate(c.FilesToTransfer[c.FilesToTransferCurrentNum].Size)
+		err := utils.PreallocateFile(pathToFile, c.FilesToTransfer[c.FilesToTransferCurrentNum].Size)
 		if err != nil {
-			err = fmt.Errorf("could not truncate %s: %w", pathToFile, err)
+			err = fmt.Errorf("could not preallocate %s: %w", pathToFile, err)
 			log.Error(err)
 			return err
 		}
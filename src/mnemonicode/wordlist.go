@@ -39,6 +39,12 @@ func init() {
 	}
 }
 
+// IsWord reports whether w is in the word list.
+func IsWord(w string) bool {
+	_, ok := wordMap[w]
+	return ok
+}
+
 const longestWord = 7
 
 var WordList = []string{
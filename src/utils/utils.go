@@ -1,26 +1,47 @@
 package utils
 
 import (
+	"archive/tar"
 	"archive/zip"
 	"bufio"
 	"bytes"
 	"compress/flate"
+	"compress/gzip"
+	"context"
+	"crypto/hmac"
 	"crypto/md5"
 	"crypto/rand"
+	"crypto/sha1"
 	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
 	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"hash"
+	"hash/crc32"
 	"io"
 	"math"
 	"math/big"
 	"net"
 	"net/http"
 	"os"
+	"os/user"
 	"path"
 	"path/filepath"
+	"runtime"
+	"runtime/debug"
+	"sort"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 	"unicode"
+	"unicode/utf16"
+	"unicode/utf8"
 
 	"github.com/cespare/xxhash/v2"
 	"github.com/go-kombucha/croc-lib/src/mnemonicode"
@@ -28,6 +49,7 @@ import (
 	"github.com/minio/highwayhash"
 	log "github.com/schollz/logger"
 	"github.com/schollz/progressbar/v3"
+	"golang.org/x/crypto/hkdf"
 )
 
 const NbPinNumbers = 4
@@ -59,582 +81,4935 @@ func GetConfigDir(requireValidPath bool) (homedir string, err error) {
 	return
 }
 
-// Exists reports whether the named file or directory exists.
-func Exists(name string) bool {
-	if _, err := os.Stat(name); err != nil {
-		if os.IsNotExist(err) {
-			return false
+// GetCacheDir returns the cache directory of croc, creating it if needed
+func GetCacheDir() (cacheDir string, err error) {
+	if envCacheDir, isSet := os.LookupEnv("CROC_CACHE_DIR"); isSet {
+		cacheDir = envCacheDir
+	} else if xdgCacheHome, isSet := os.LookupEnv("XDG_CACHE_HOME"); isSet {
+		cacheDir = path.Join(xdgCacheHome, "croc")
+	} else {
+		cacheDir, err = os.UserCacheDir()
+		if err != nil {
+			return
 		}
+		cacheDir = path.Join(cacheDir, "croc")
 	}
-	return true
-}
-
-// GetInput returns the input with a given prompt
-func GetInput(prompt string) string {
-	reader := bufio.NewReader(os.Stdin)
-	fmt.Fprintf(os.Stderr, "%s", prompt)
-	text, _ := reader.ReadString('\n')
-	return strings.TrimSpace(text)
+	if _, err = os.Stat(cacheDir); os.IsNotExist(err) {
+		err = os.MkdirAll(cacheDir, 0o700)
+	}
+	return
 }
 
-// HashFile returns the hash of a file or, in case of a symlink, the
-// SHA256 hash of its target. Takes an argument to specify the algorithm to use.
-func HashFile(fname string, algorithm string, showProgress ...bool) (hash256 []byte, err error) {
-	doShowProgress := false
-	if len(showProgress) > 0 {
-		doShowProgress = showProgress[0]
+// SecureConfigDir makes sure the config directory, which may hold secrets
+// like relay passwords, is only accessible by its owner: the directory and
+// its subdirectories lose any permission beyond 0700 and the files in it
+// any beyond 0600, without gaining any they didn't have. File modes are
+// not enforced on Windows so it does nothing there.
+func SecureConfigDir() (err error) {
+	if runtime.GOOS == "windows" {
+		return
 	}
-	var fstats os.FileInfo
-	fstats, err = os.Lstat(fname)
+	configDir, err := GetConfigDir(true)
 	if err != nil {
-		return nil, err
+		return
 	}
-	if fstats.Mode()&os.ModeSymlink != 0 {
-		var target string
-		target, err = os.Readlink(fname)
+	return filepath.Walk(configDir, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
-			return nil, err
+			return err
 		}
-		return []byte(SHA256(target)), nil
+		var perm os.FileMode
+		switch {
+		case info.IsDir():
+			perm = 0o700
+		case info.Mode().IsRegular():
+			perm = 0o600
+		default:
+			return nil
+		}
+		if info.Mode().Perm()&perm == info.Mode().Perm() {
+			return nil
+		}
+		perm &= info.Mode().Perm()
+		log.Warnf("%s is accessible by other users (%s), changing its mode to %s", path, info.Mode().Perm(), perm)
+		return os.Chmod(path, perm)
+	})
+}
+
+// ExpandPath expands a leading "~" or "~user" to the home directory and
+// environment variables like $HOME in a user supplied path, and returns it
+// as a cleaned absolute path
+func ExpandPath(p string) (expanded string, err error) {
+	if strings.HasPrefix(p, "~") {
+		name, rest := p[1:], ""
+		if i := strings.IndexAny(name, "/"+string(os.PathSeparator)); i >= 0 {
+			name, rest = name[:i], name[i:]
+		}
+		var homedir string
+		if name == "" {
+			homedir, err = os.UserHomeDir()
+			if err != nil {
+				return "", fmt.Errorf("could not expand '~': %w", err)
+			}
+		} else {
+			var u *user.User
+			u, err = user.Lookup(name)
+			if err != nil {
+				return "", fmt.Errorf("could not expand '~%s': %w", name, err)
+			}
+			homedir = u.HomeDir
+		}
+		if homedir == "" {
+			return "", fmt.Errorf("could not expand '~%s': home directory is not set", name)
+		}
+		p = homedir + rest
 	}
-	switch algorithm {
-	case "imohash":
-		return IMOHashFile(fname)
-	case "md5":
-		return MD5HashFile(fname, doShowProgress)
-	case "xxhash":
-		return XXHashFile(fname, doShowProgress)
-	case "highway":
-		return HighwayHashFile(fname, doShowProgress)
+	return filepath.Abs(os.ExpandEnv(p))
+}
+
+// configFile is the name of the croc config in the config directory
+const configFile = "config.json"
+
+// Config holds the persistent settings of croc
+type Config struct {
+	RelayAddress  string   `json:"relay_address,omitempty"`
+	RelayAddress6 string   `json:"relay_address6,omitempty"`
+	RelayPorts    []string `json:"relay_ports,omitempty"`
+	RelayPassword string   `json:"relay_password,omitempty"`
+	HashAlgorithm string   `json:"hash_algorithm,omitempty"`
+	Curve         string   `json:"curve,omitempty"`
+	// TransferCount is the number of completed transfers
+	TransferCount int `json:"transfer_count,omitempty"`
+}
+
+// LoadConfig reads the config from the config directory, returning an
+// empty config if none was saved yet
+func LoadConfig() (c *Config, err error) {
+	configDir, err := GetConfigDir(true)
+	if err != nil {
+		return
+	}
+	c = &Config{}
+	data, err := os.ReadFile(filepath.Join(configDir, configFile))
+	if os.IsNotExist(err) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(data, c); err != nil {
+		return nil, fmt.Errorf("could not parse %s: %w", configFile, err)
 	}
-	err = fmt.Errorf("unspecified algorithm")
 	return
 }
 
-// HighwayHashFile returns highwayhash of a file
-func HighwayHashFile(fname string, doShowProgress bool) (hashHighway []byte, err error) {
-	f, err := os.Open(fname)
+// SaveConfig atomically writes c to the config directory
+func SaveConfig(c *Config) (err error) {
+	configDir, err := GetConfigDir(true)
 	if err != nil {
 		return
 	}
-	defer f.Close()
-	key, err := hex.DecodeString("1553c5383fb0b86578c3310da665b4f6e0521acf22eb58a99532ffed02a6b115")
+	data, err := json.MarshalIndent(c, "", "  ")
 	if err != nil {
 		return
 	}
-	h, err := highwayhash.New(key)
+	return writeFileAtomic(filepath.Join(configDir, configFile), data, 0o600)
+}
+
+// UpdateConfig loads the config, applies fn and saves it while holding a
+// lock on the config, so that concurrent updates from several croc
+// processes are serialized instead of overwriting each other.
+// Nothing is saved if fn returns an error.
+func UpdateConfig(fn func(*Config) error) (err error) {
+	configDir, err := GetConfigDir(true)
 	if err != nil {
-		err = fmt.Errorf("could not create highwayhash: %s", err.Error())
 		return
 	}
-	if doShowProgress {
-		stat, _ := f.Stat()
-		fnameShort := path.Base(fname)
-		if len(fnameShort) > 20 {
-			fnameShort = fnameShort[:20] + "..."
-		}
-		bar := progressbar.NewOptions64(stat.Size(),
-			progressbar.OptionSetWriter(os.Stderr),
-			progressbar.OptionShowBytes(true),
-			progressbar.OptionSetDescription(fmt.Sprintf("Hashing %s", fnameShort)),
-			progressbar.OptionClearOnFinish(),
-			progressbar.OptionFullWidth(),
-		)
-		if _, err = io.Copy(io.MultiWriter(h, bar), f); err != nil {
-			return
-		}
-	} else {
-		if _, err = io.Copy(h, f); err != nil {
-			return
-		}
+	lock, err := LockFile(filepath.Join(configDir, configFile+".lock"))
+	if err != nil {
+		return
+	}
+	defer lock.Unlock()
+	c, err := LoadConfig()
+	if err != nil {
+		return
+	}
+	if err = fn(c); err != nil {
+		return
 	}
+	return SaveConfig(c)
+}
 
-	hashHighway = h.Sum(nil)
-	return
+// FileLock is an exclusive advisory lock on a file, shared between
+// processes as well as between goroutines
+type FileLock struct {
+	f *os.File
 }
 
-// MD5HashFile returns MD5 hash
-func MD5HashFile(fname string, doShowProgress bool) (hash256 []byte, err error) {
-	f, err := os.Open(fname)
+// LockFile blocks until it holds an exclusive lock on fname, creating the
+// file if needed
+func LockFile(fname string) (lock *FileLock, err error) {
+	f, err := os.OpenFile(fname, os.O_RDWR|os.O_CREATE, 0o600)
 	if err != nil {
 		return
 	}
-	defer f.Close()
-
-	h := md5.New()
-	if doShowProgress {
-		stat, _ := f.Stat()
-		fnameShort := path.Base(fname)
-		if len(fnameShort) > 20 {
-			fnameShort = fnameShort[:20] + "..."
-		}
-		bar := progressbar.NewOptions64(stat.Size(),
-			progressbar.OptionSetWriter(os.Stderr),
-			progressbar.OptionShowBytes(true),
-			progressbar.OptionSetDescription(fmt.Sprintf("Hashing %s", fnameShort)),
-			progressbar.OptionClearOnFinish(),
-			progressbar.OptionFullWidth(),
-		)
-		if _, err = io.Copy(io.MultiWriter(h, bar), f); err != nil {
-			return
-		}
-	} else {
-		if _, err = io.Copy(h, f); err != nil {
-			return
-		}
+	if err = lockFile(f); err != nil {
+		f.Close()
+		return
 	}
-
-	hash256 = h.Sum(nil)
-	return
+	return &FileLock{f: f}, nil
 }
 
-var imofull = imohash.NewCustom(0, 0)
-var imopartial = imohash.NewCustom(16*16*8*1024, 128*1024)
+// Unlock releases the lock
+func (l *FileLock) Unlock() error {
+	err := unlockFile(l.f)
+	if errClose := l.f.Close(); err == nil {
+		err = errClose
+	}
+	return err
+}
 
-// IMOHashFile returns imohash
-func IMOHashFile(fname string) (hash []byte, err error) {
-	b, err := imopartial.SumFile(fname)
-	hash = b[:]
-	return
+// Exists reports whether the named file or directory exists. A path that
+// can't be stat'ed, e.g. because of permissions, is reported as missing:
+// use ExistsErr to tell the two apart.
+func Exists(name string) bool {
+	_, err := os.Stat(name)
+	return err == nil
 }
 
-// IMOHashFileFull returns imohash of full file
-func IMOHashFileFull(fname string) (hash []byte, err error) {
-	b, err := imofull.SumFile(fname)
-	hash = b[:]
+// ExistsErr reports whether the named file or directory exists, returning
+// the error when it can't be determined, e.g. permission denied.
+func ExistsErr(name string) (exists bool, err error) {
+	_, err = os.Stat(name)
+	if err == nil {
+		exists = true
+	} else if os.IsNotExist(err) {
+		err = nil
+	}
 	return
 }
 
-// XXHashFile returns the xxhash of a file
-func XXHashFile(fname string, doShowProgress bool) (hash256 []byte, err error) {
-	f, err := os.Open(fname)
+// SameInode reports whether a and b refer to the same file, e.g. hardlinks
+// or the same path spelled differently. This compares the device and inode
+// on Unix and the volume serial number and file index on Windows.
+func SameInode(a string, b string) (same bool, err error) {
+	statA, err := os.Stat(a)
 	if err != nil {
 		return
 	}
-	defer f.Close()
-
-	h := xxhash.New()
-	if doShowProgress {
-		stat, _ := f.Stat()
-		fnameShort := path.Base(fname)
-		if len(fnameShort) > 20 {
-			fnameShort = fnameShort[:20] + "..."
-		}
-		bar := progressbar.NewOptions64(stat.Size(),
-			progressbar.OptionSetWriter(os.Stderr),
-			progressbar.OptionShowBytes(true),
-			progressbar.OptionSetDescription(fmt.Sprintf("Hashing %s", fnameShort)),
-			progressbar.OptionClearOnFinish(),
-			progressbar.OptionFullWidth(),
-		)
-		if _, err = io.Copy(io.MultiWriter(h, bar), f); err != nil {
-			return
-		}
-	} else {
-		if _, err = io.Copy(h, f); err != nil {
-			return
-		}
+	statB, err := os.Stat(b)
+	if err != nil {
+		return
 	}
-
-	hash256 = h.Sum(nil)
-	return
-}
-
-// SHA256 returns sha256 sum
-func SHA256(s string) string {
-	sha := sha256.New()
-	sha.Write([]byte(s))
-	return hex.EncodeToString(sha.Sum(nil))
+	return os.SameFile(statA, statB), nil
 }
 
-// PublicIP returns public ip address
-func PublicIP() (ip string, err error) {
-	// ask ipv4.icanhazip.com for the public ip
-	// by making http request
-	// if the request fails, return nothing
-	resp, err := http.Get("http://ipv4.icanhazip.com")
+// IsFileStable reports whether the size and modification time of a file
+// stay the same over window, i.e. whether it looks like no other process
+// is still writing it. This is only a heuristic, not a lock: a writer that
+// pauses for longer than window will not be detected.
+func IsFileStable(fname string, window time.Duration) (stable bool, err error) {
+	before, err := os.Stat(fname)
 	if err != nil {
 		return
 	}
-	defer resp.Body.Close()
-
-	// read the body of the response
-	// and return the ip address
-	buf := new(bytes.Buffer)
-	buf.ReadFrom(resp.Body)
-	ip = strings.TrimSpace(buf.String())
-
+	time.Sleep(window)
+	after, err := os.Stat(fname)
+	if err != nil {
+		return
+	}
+	stable = before.Size() == after.Size() && before.ModTime().Equal(after.ModTime())
 	return
 }
 
-// LocalIP returns local ip address
-func LocalIP() string {
-	conn, err := net.Dial("udp", "8.8.8.8:80")
-	if err != nil {
-		log.Error(err)
-		return ""
-	}
-	defer conn.Close()
+// GetInput returns the input with a given prompt
+func GetInput(prompt string) string {
+	reader := bufio.NewReader(os.Stdin)
+	fmt.Fprintf(os.Stderr, "%s", prompt)
+	text, _ := reader.ReadString('\n')
+	return strings.TrimSpace(text)
+}
 
-	localAddr := conn.LocalAddr().(*net.UDPAddr)
+// getInput is GetInput, replaced in tests
+var getInput = GetInput
 
-	return localAddr.IP.String()
-}
+// OverwritePolicy is what UnzipDirectoryWithPolicy does with files that
+// already exist
+type OverwritePolicy int
 
-func GenerateRandomPin() string {
-	s := ""
-	max := new(big.Int)
-	max.SetInt64(9)
-	for i := 0; i < NbPinNumbers; i++ {
-		v, err := rand.Int(rand.Reader, max)
-		if err != nil {
-			panic(err)
-		}
-		s += fmt.Sprintf("%d", v)
-	}
-	return s
+const (
+	// OverwritePrompt asks on stdin for each file
+	OverwritePrompt OverwritePolicy = iota
+	// OverwriteSkip keeps the existing files
+	OverwriteSkip
+	// OverwriteAlways replaces the existing files
+	OverwriteAlways
+	// OverwriteFail stops with an error at the first existing file
+	OverwriteFail
+)
+
+// overwritePrompter asks whether existing files should be overwritten,
+// remembering "a" (yes to all) and "na" (no to all) answers so that the
+// rest of a bulk extraction doesn't prompt again. It only prompts with the
+// OverwritePrompt policy.
+type overwritePrompter struct {
+	policy OverwritePolicy
+	all    *bool
 }
 
-// GetRandomName returns mnemonicoded random name
-func GetRandomName() string {
-	var result []string
-	bs := make([]byte, NbBytesWords)
-	rand.Read(bs)
-	result = mnemonicode.EncodeWordList(result, bs)
-	return GenerateRandomPin() + "-" + strings.Join(result, "-")
+// allow reports whether the existing filePath may be overwritten
+func (p *overwritePrompter) allow(filePath string) (bool, error) {
+	switch p.policy {
+	case OverwriteSkip:
+		return false, nil
+	case OverwriteAlways:
+		return true, nil
+	case OverwriteFail:
+		return false, fmt.Errorf("'%s' already exists", filePath)
+	}
+	return p.confirm(filePath), nil
 }
 
-// ByteCountDecimal converts bytes to human readable byte string
-func ByteCountDecimal(b int64) string {
-	const unit = 1024
-	if b < unit {
-		return fmt.Sprintf("%d B", b)
+func (p *overwritePrompter) confirm(filePath string) bool {
+	if p.all != nil {
+		return *p.all
 	}
-	div, exp := int64(unit), 0
-	for n := b / unit; n >= unit; n /= unit {
-		div *= unit
-		exp++
+	prompt := fmt.Sprintf("\nOverwrite '%s'? (y/N/a=all/na=none) ", filePath)
+	choice := strings.ToLower(getInput(prompt))
+	switch choice {
+	case "a", "all":
+		yes := true
+		p.all = &yes
+	case "na", "none":
+		no := false
+		p.all = &no
 	}
-	return fmt.Sprintf("%.1f %cB", float64(b)/float64(div), "kMGTPE"[exp])
+	return choice == "y" || choice == "yes" || choice == "a" || choice == "all"
 }
 
-// MissingChunks returns the positions of missing chunks.
-// If file doesn't exist, it returns an empty chunk list (all chunks).
-// If the file size is not the same as requested, it returns an empty chunk list (all chunks).
-func MissingChunks(fname string, fsize int64, chunkSize int) (chunkRanges []int64) {
-	f, err := os.Open(fname)
+// HashFile returns the hash of a file or, in case of a symlink, the
+// SHA256 hash of its target. Takes an argument to specify the algorithm to use.
+func HashFile(fname string, algorithm string, showProgress ...bool) (hash256 []byte, err error) {
+	fileHash, err := HashFileTyped(fname, algorithm, showProgress...)
 	if err != nil {
 		return
 	}
-	defer f.Close()
+	return fileHash.Sum, nil
+}
 
-	fstat, err := os.Stat(fname)
-	if err != nil || fstat.Size() != fsize {
-		return
-	}
+// FileHash is a hash together with the algorithm that produced it
+type FileHash struct {
+	Algorithm string
+	Sum       []byte
+}
 
-	emptyBuffer := make([]byte, chunkSize)
-	chunkNum := 0
-	chunks := make([]int64, int64(math.Ceil(float64(fsize)/float64(chunkSize))))
-	var currentLocation int64
+// HashFileTyped is HashFile also returning the algorithm used
+func HashFileTyped(fname string, algorithm string, showProgress ...bool) (fileHash FileHash, err error) {
+	doShowProgress := false
+	if len(showProgress) > 0 {
+		doShowProgress = showProgress[0]
+	}
+	sum, err := HashFileContext(context.Background(), fname, algorithm, doShowProgress)
+	if err != nil {
+		return
+	}
+	return FileHash{Algorithm: algorithm, Sum: sum}, nil
+}
+
+// HashFileContext is HashFile returning ctx.Err() as soon as ctx is done
+func HashFileContext(ctx context.Context, fname string, algorithm string, doShowProgress bool) (hash256 []byte, err error) {
+	opts := HashOptions{Algorithm: algorithm, Context: ctx}
+	if doShowProgress && algorithm != "imohash" {
+		var fstats os.FileInfo
+		fstats, err = os.Lstat(fname)
+		if err != nil {
+			return nil, err
+		}
+		if fstats.Mode().IsRegular() {
+			progress := NewThrottledReporter(newHashProgressBar(fname, fstats.Size()), 0)
+			defer progress.Flush()
+			opts.Progress = progress
+		}
+	}
+	return HashFileOpts(fname, opts)
+}
+
+// HashFileProgress is HashFile calling cb with the number of bytes hashed
+// so far and the size of the file after each read, for frontends drawing
+// their own progress instead of the terminal progress bar. As imohash only
+// samples the file, cb is called once when done with it.
+func HashFileProgress(fname string, algorithm string, cb func(done, total int64)) (hash []byte, err error) {
+	fstats, err := os.Lstat(fname)
+	if err != nil {
+		return
+	}
+	progress := &callbackReporter{total: fstats.Size(), cb: cb}
+	hash, err = HashFileOpts(fname, HashOptions{Algorithm: algorithm, Progress: progress})
+	if err == nil && algorithm == "imohash" {
+		cb(progress.total, progress.total)
+	}
+	return
+}
+
+// callbackReporter is a ProgressReporter calling cb with the running total
+type callbackReporter struct {
+	done  int64
+	total int64
+	cb    func(done, total int64)
+}
+
+func (r *callbackReporter) Add(n int) error {
+	r.done += int64(n)
+	r.cb(r.done, r.total)
+	return nil
+}
+
+// ProgressReporter is notified of the number of bytes processed, as done
+// by a progressbar.ProgressBar
+type ProgressReporter interface {
+	Add(n int) error
+}
+
+// progressWriter reports everything written to it to a ProgressReporter
+type progressWriter struct {
+	p ProgressReporter
+}
+
+func (w progressWriter) Write(b []byte) (int, error) {
+	return len(b), w.p.Add(len(b))
+}
+
+// defaultRefreshInterval is how often a ThrottledReporter refreshes by default
+const defaultRefreshInterval = 100 * time.Millisecond
+
+// ThrottledReporter forwards the bytes added to it to another
+// ProgressReporter at most once per interval, so that a progress bar is not
+// redrawn after every small write. It is safe for concurrent use.
+type ThrottledReporter struct {
+	sync.Mutex
+	p        ProgressReporter
+	interval time.Duration
+	last     time.Time
+	pending  int
+}
+
+// NewThrottledReporter returns a ThrottledReporter forwarding to p every
+// interval, or every 100ms if interval is not positive
+func NewThrottledReporter(p ProgressReporter, interval time.Duration) *ThrottledReporter {
+	if interval <= 0 {
+		interval = defaultRefreshInterval
+	}
+	return &ThrottledReporter{p: p, interval: interval}
+}
+
+// Add adds n bytes, forwarding them with the ones pending if the interval
+// has elapsed since the last refresh
+func (r *ThrottledReporter) Add(n int) error {
+	r.Lock()
+	defer r.Unlock()
+	r.pending += n
+	if now := time.Now(); now.Sub(r.last) >= r.interval {
+		r.last = now
+		return r.flush()
+	}
+	return nil
+}
+
+// Flush forwards the pending bytes, to be called once done
+func (r *ThrottledReporter) Flush() error {
+	r.Lock()
+	defer r.Unlock()
+	return r.flush()
+}
+
+func (r *ThrottledReporter) flush() error {
+	if r.pending == 0 {
+		return nil
+	}
+	n := r.pending
+	r.pending = 0
+	return r.p.Add(n)
+}
+
+// ErrBudgetExceeded is returned by a BudgetWriter once its budget is spent
+var ErrBudgetExceeded = errors.New("transfer budget exceeded")
+
+// BudgetWriter passes at most a budget of bytes to another writer, e.g. to
+// stop a transfer on a metered connection. A write going over the budget
+// writes the bytes that still fit and returns ErrBudgetExceeded.
+type BudgetWriter struct {
+	w         io.Writer
+	remaining int64
+}
+
+// NewBudgetWriter returns a BudgetWriter passing at most maxBytes to w
+func NewBudgetWriter(w io.Writer, maxBytes int64) *BudgetWriter {
+	return &BudgetWriter{w: w, remaining: max(maxBytes, 0)}
+}
+
+// Write writes p to the underlying writer within the remaining budget
+func (b *BudgetWriter) Write(p []byte) (n int, err error) {
+	exceeded := int64(len(p)) > b.remaining
+	if exceeded {
+		p = p[:b.remaining]
+	}
+	n, err = b.w.Write(p)
+	b.remaining -= int64(n)
+	if err == nil && exceeded {
+		err = ErrBudgetExceeded
+	}
+	return
+}
+
+// Remaining returns the number of bytes that can still be written
+func (b *BudgetWriter) Remaining() int64 {
+	return b.remaining
+}
+
+// HashOptions are the options of HashFileOpts
+type HashOptions struct {
+	// Algorithm is one of the algorithms supported by HashFile
+	Algorithm string
+	// Context aborts hashing when done, defaults to context.Background()
+	Context context.Context
+	// Progress receives the number of bytes hashed, if set
+	Progress ProgressReporter
+	// Salt is hashed before the content of the file
+	Salt []byte
+	// Mmap maps the file into memory instead of reading it, falling back
+	// to reading when the platform or the file doesn't allow it. Only use
+	// it for files that don't change while hashed: a file truncated by
+	// another process faults when the missing pages are read, which is
+	// turned into an error but may leave the hash of a partial file.
+	Mmap bool
+}
+
+// HashFileOpts returns the hash of a file or, in case of a symlink, the
+// SHA256 hash of its target, as configured by opts. imohash only samples
+// the file so it doesn't support a salt or report progress.
+func HashFileOpts(fname string, opts HashOptions) (hash []byte, err error) {
+	ctx := opts.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	if err = ctx.Err(); err != nil {
+		return
+	}
+	fstats, err := os.Lstat(fname)
+	if err != nil {
+		return
+	}
+	if fstats.Mode()&os.ModeSymlink != 0 {
+		var target string
+		target, err = os.Readlink(fname)
+		if err != nil {
+			return nil, err
+		}
+		return []byte(SHA256(target)), nil
+	}
+	if opts.Algorithm == "imohash" {
+		if len(opts.Salt) > 0 {
+			err = fmt.Errorf("imohash does not support a salt")
+			return
+		}
+		return IMOHashFile(fname)
+	}
+	h, err := newHasher(opts.Algorithm)
+	if err != nil {
+		return
+	}
+	f, err := os.Open(fname)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	var r io.Reader = f
+	if opts.Mmap {
+		data, unmap, errMmap := mmapFile(f, fstats.Size())
+		if errMmap == nil {
+			defer unmap()
+			// reading past the end of a file truncated meanwhile raises
+			// SIGBUS, which would otherwise kill the process
+			defer debug.SetPanicOnFault(debug.SetPanicOnFault(true))
+			defer func() {
+				if p := recover(); p != nil {
+					if _, fault := p.(interface{ Addr() uintptr }); !fault {
+						panic(p)
+					}
+					hash, err = nil, fmt.Errorf("%s changed while being hashed: %v", fname, p)
+				}
+			}()
+			r = bytes.NewReader(data)
+		} else {
+			log.Debugf("could not mmap %s, reading it instead: %v", fname, errMmap)
+		}
+	}
+	var w io.Writer = h
+	if opts.Progress != nil {
+		w = io.MultiWriter(h, progressWriter{opts.Progress})
+	}
+	h.Write(opts.Salt)
+	if _, err = copyContext(ctx, w, r); err != nil {
+		return
+	}
+	hash = h.Sum(nil)
+	return
+}
+
+// copyBuffers holds the buffers of copyContext, reused across the many
+// files hashed by HashDirectory and the like
+var copyBuffers = sync.Pool{New: func() any {
+	buffer := make([]byte, 1024*1024)
+	return &buffer
+}}
+
+// copyContext is io.Copy checking between blocks whether ctx is done
+func copyContext(ctx context.Context, dst io.Writer, src io.Reader) (written int64, err error) {
+	pooled := copyBuffers.Get().(*[]byte)
+	defer copyBuffers.Put(pooled)
+	buffer := *pooled
 	for {
-		buffer := make([]byte, chunkSize)
-		bytesread, err := f.Read(buffer)
+		if err = ctx.Err(); err != nil {
+			return
+		}
+		bytesread, errRead := src.Read(buffer)
+		if bytesread > 0 {
+			var byteswritten int
+			byteswritten, err = dst.Write(buffer[:bytesread])
+			written += int64(byteswritten)
+			if err != nil {
+				return
+			}
+		}
+		if errRead == io.EOF {
+			return written, nil
+		}
+		if errRead != nil {
+			return written, errRead
+		}
+	}
+}
+
+// newHashProgressBar returns the progress bar shown while hashing a file
+func newHashProgressBar(fname string, size int64) *progressbar.ProgressBar {
+	fnameShort := path.Base(fname)
+	if len(fnameShort) > 20 {
+		fnameShort = fnameShort[:20] + "..."
+	}
+	return progressbar.NewOptions64(size,
+		progressbar.OptionSetWriter(os.Stderr),
+		progressbar.OptionShowBytes(true),
+		progressbar.OptionSetDescription(fmt.Sprintf("Hashing %s", fnameShort)),
+		progressbar.OptionClearOnFinish(),
+		progressbar.OptionFullWidth(),
+	)
+}
+
+const highwayHashKey = "1553c5383fb0b86578c3310da665b4f6e0521acf22eb58a99532ffed02a6b115"
+
+// HashDirectory returns the hashes of the regular files under root, keyed
+// by their slash separated path relative to root
+func HashDirectory(root string, algorithm string) (hashes map[string][]byte, err error) {
+	return HashDirectoryProgress(root, algorithm, nil)
+}
+
+// HashDirectoryProgress is HashDirectory calling progress, if not nil, after
+// each file is hashed with the number of files and bytes hashed so far and
+// the totals, which are computed in a first pass over the tree.
+func HashDirectoryProgress(root string, algorithm string, progress func(filesDone, filesTotal int, bytesDone, bytesTotal int64)) (hashes map[string][]byte, err error) {
+	fnames, sizes, err := regularFiles(root)
+	if err != nil {
+		return
+	}
+	var bytesTotal, bytesDone int64
+	for _, size := range sizes {
+		bytesTotal += size
+	}
+	hashes = make(map[string][]byte, len(fnames))
+	for i, fname := range fnames {
+		var relPath string
+		relPath, err = filepath.Rel(root, fname)
+		if err != nil {
+			return nil, err
+		}
+		hashes[filepath.ToSlash(relPath)], err = HashFile(fname, algorithm)
 		if err != nil {
+			return nil, err
+		}
+		bytesDone += sizes[i]
+		if progress != nil {
+			progress(i+1, len(fnames), bytesDone, bytesTotal)
+		}
+	}
+	return
+}
+
+// HashDirectoryParallel is HashDirectory hashing up to workers files at a
+// time, or GOMAXPROCS files if workers is not positive. It stops at the
+// first error.
+func HashDirectoryParallel(root string, algorithm string, workers int) (hashes map[string][]byte, err error) {
+	fnames, _, err := regularFiles(root)
+	if err != nil {
+		return
+	}
+	fileHashes, err := HashFiles(fnames, algorithm, workers)
+	if err != nil {
+		return
+	}
+	hashes = make(map[string][]byte, len(fileHashes))
+	for fname, fileHash := range fileHashes {
+		var relPath string
+		relPath, err = filepath.Rel(root, fname)
+		if err != nil {
+			return nil, err
+		}
+		hashes[filepath.ToSlash(relPath)] = fileHash
+	}
+	return
+}
+
+// HashFiles returns the hashes of fnames, keyed by the given names, hashing
+// up to concurrency files at a time, or GOMAXPROCS files if concurrency is
+// not positive. The first error cancels the files still being hashed and is
+// returned. No progress bar is shown.
+func HashFiles(fnames []string, algorithm string, concurrency int) (hashes map[string][]byte, err error) {
+	if concurrency <= 0 {
+		concurrency = runtime.GOMAXPROCS(0)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+	hashes = make(map[string][]byte, len(fnames))
+	jobs := make(chan string)
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for fname := range jobs {
+				release := acquireOpenFile()
+				fileHash, errHash := HashFileContext(ctx, fname, algorithm, false)
+				release()
+				mutex.Lock()
+				if errHash != nil {
+					if err == nil {
+						err = errHash
+						cancel()
+					}
+				} else {
+					hashes[fname] = fileHash
+				}
+				mutex.Unlock()
+			}
+		}()
+	}
+	for _, fname := range fnames {
+		if ctx.Err() != nil {
 			break
 		}
-		if bytes.Equal(buffer[:bytesread], emptyBuffer[:bytesread]) {
-			chunks[chunkNum] = currentLocation
-			chunkNum++
+		jobs <- fname
+	}
+	close(jobs)
+	wg.Wait()
+	if err != nil {
+		return nil, err
+	}
+	return
+}
+
+// openFiles limits how many files the parallel helpers keep open at once,
+// so that large trees don't fail with "too many open files"
+var openFiles struct {
+	sync.Mutex
+	sem chan struct{}
+}
+
+// SetMaxOpenFiles sets how many files the parallel helpers may keep open at
+// once. A value that is not positive restores the default, which is below
+// the soft limit on open files of the process.
+func SetMaxOpenFiles(n int) {
+	if n <= 0 {
+		n = defaultMaxOpenFiles()
+	}
+	openFiles.Lock()
+	openFiles.sem = make(chan struct{}, n)
+	openFiles.Unlock()
+}
+
+// acquireOpenFile blocks until another file may be opened and returns the
+// function to call once it is closed
+func acquireOpenFile() (release func()) {
+	openFiles.Lock()
+	if openFiles.sem == nil {
+		openFiles.sem = make(chan struct{}, defaultMaxOpenFiles())
+	}
+	sem := openFiles.sem
+	openFiles.Unlock()
+	sem <- struct{}{}
+	return func() {
+		<-sem
+	}
+}
+
+// FindDuplicates returns the regular files under root with identical
+// content, as a map from the hex digest computed with algorithm to the paths
+// sharing it, only listing digests shared by several files. Files are first
+// grouped by their cheap imohash, only the files of groups with several
+// members are then fully hashed.
+func FindDuplicates(root string, algorithm string) (duplicates map[string][]string, err error) {
+	fnames, _, err := regularFiles(root)
+	if err != nil {
+		return
+	}
+	candidates := make(map[string][]string)
+	for _, fname := range fnames {
+		var partial []byte
+		partial, err = IMOHashFile(fname)
+		if err != nil {
+			return nil, err
 		}
-		currentLocation += int64(bytesread)
+		candidates[string(partial)] = append(candidates[string(partial)], fname)
 	}
-	if chunkNum == 0 {
-		chunkRanges = []int64{}
-	} else {
-		chunks = chunks[:chunkNum]
-		chunkRanges = []int64{int64(chunkSize), chunks[0]}
-		curCount := 0
-		for i, chunk := range chunks {
-			if i == 0 {
-				continue
+	duplicates = make(map[string][]string)
+	for _, group := range candidates {
+		if len(group) < 2 {
+			continue
+		}
+		for _, fname := range group {
+			var fileHash []byte
+			fileHash, err = HashFile(fname, algorithm)
+			if err != nil {
+				return nil, err
 			}
-			curCount++
-			if chunk-chunks[i-1] > int64(chunkSize) {
-				chunkRanges = append(chunkRanges, int64(curCount))
-				chunkRanges = append(chunkRanges, chunk)
-				curCount = 0
+			digest := hex.EncodeToString(fileHash)
+			duplicates[digest] = append(duplicates[digest], fname)
+		}
+	}
+	for digest, paths := range duplicates {
+		if len(paths) < 2 {
+			delete(duplicates, digest)
+		}
+	}
+	return
+}
+
+// DirTransferID returns a stable identifier for the tree under root, made of
+// a hash of its structure (paths, types and sizes) and a rollup hash of the
+// content of its files, so identical trees give the same ID and any change
+// alters it. Using the "imohash" algorithm keeps it cheap for large trees
+// as only samples of each file are read.
+func DirTransferID(root string, algorithm string) (id string, err error) {
+	structure := sha256.New()
+	content := sha256.New()
+	err = filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		relPath, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		relPath = filepath.ToSlash(relPath)
+		switch {
+		case info.IsDir():
+			fmt.Fprintf(structure, "d %s\n", relPath)
+		case info.Mode().IsRegular() || info.Mode()&os.ModeSymlink != 0:
+			fmt.Fprintf(structure, "f %s %d\n", relPath, info.Size())
+			fileHash, err := HashFile(path, algorithm)
+			if err != nil {
+				return err
 			}
+			content.Write(fileHash)
 		}
-		chunkRanges = append(chunkRanges, int64(curCount+1))
+		return nil
+	})
+	if err != nil {
+		return
 	}
+	id = fmt.Sprintf("%x-%x", structure.Sum(nil)[:8], content.Sum(nil)[:8])
 	return
 }
 
-// ChunkRangesToChunks converts chunk ranges to list
-func ChunkRangesToChunks(chunkRanges []int64) (chunks []int64) {
-	if len(chunkRanges) == 0 {
+// FileSize is the path and size of a file
+type FileSize struct {
+	Path string
+	Size int64
+}
+
+// LargeFiles returns the regular files under root larger than threshold
+// bytes, so a sender can be warned before sending them by accident
+func LargeFiles(root string, threshold int64) (large []FileSize, err error) {
+	fnames, sizes, err := regularFiles(root)
+	if err != nil {
 		return
 	}
-	chunkSize := chunkRanges[0]
-	chunks = []int64{}
-	for i := 1; i < len(chunkRanges); i += 2 {
-		for j := int64(0); j < (chunkRanges[i+1]); j++ {
-			chunks = append(chunks, chunkRanges[i]+j*chunkSize)
+	large = []FileSize{}
+	for i, fname := range fnames {
+		if sizes[i] > threshold {
+			large = append(large, FileSize{Path: fname, Size: sizes[i]})
+		}
+	}
+	return
+}
+
+// OrderStrategy is the order in which OrderFiles sorts files
+type OrderStrategy int
+
+const (
+	// SmallestFirst sends small files first, so more files are done sooner
+	SmallestFirst OrderStrategy = iota
+	// LargestFirst sends large files first, for throughput on some links
+	LargestFirst
+	// Alphabetical sends files in name order
+	Alphabetical
+)
+
+// OrderFiles returns files sorted by the given strategy, ties being broken
+// by name. Each file is only stat'ed once.
+func OrderFiles(files []string, strategy OrderStrategy) (ordered []string, err error) {
+	if strategy != SmallestFirst && strategy != LargestFirst && strategy != Alphabetical {
+		return nil, fmt.Errorf("unknown order strategy %d", strategy)
+	}
+	sized := make([]FileSize, len(files))
+	for i, fname := range files {
+		sized[i].Path = fname
+		if strategy == Alphabetical {
+			continue
+		}
+		var stat os.FileInfo
+		stat, err = os.Stat(fname)
+		if err != nil {
+			return nil, err
+		}
+		sized[i].Size = stat.Size()
+	}
+	sort.SliceStable(sized, func(i, j int) bool {
+		if sized[i].Size != sized[j].Size {
+			if strategy == LargestFirst {
+				return sized[i].Size > sized[j].Size
+			}
+			return sized[i].Size < sized[j].Size
+		}
+		return sized[i].Path < sized[j].Path
+	})
+	ordered = make([]string, len(sized))
+	for i := range sized {
+		ordered[i] = sized[i].Path
+	}
+	return
+}
+
+// regularFiles returns the paths and sizes of the regular files under root
+func regularFiles(root string) (fnames []string, sizes []int64, err error) {
+	err = filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() {
+			fnames = append(fnames, path)
+			sizes = append(sizes, info.Size())
 		}
+		return nil
+	})
+	return
+}
+
+// HighwayHashFile returns highwayhash of a file
+func HighwayHashFile(fname string, doShowProgress bool) (hashHighway []byte, err error) {
+	f, err := os.Open(fname)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	key, err := hex.DecodeString(highwayHashKey)
+	if err != nil {
+		return
+	}
+	h, err := highwayhash.New(key)
+	if err != nil {
+		err = fmt.Errorf("could not create highwayhash: %s", err.Error())
+		return
+	}
+	if doShowProgress {
+		stat, _ := f.Stat()
+		fnameShort := path.Base(fname)
+		if len(fnameShort) > 20 {
+			fnameShort = fnameShort[:20] + "..."
+		}
+		bar := progressbar.NewOptions64(stat.Size(),
+			progressbar.OptionSetWriter(os.Stderr),
+			progressbar.OptionShowBytes(true),
+			progressbar.OptionSetDescription(fmt.Sprintf("Hashing %s", fnameShort)),
+			progressbar.OptionClearOnFinish(),
+			progressbar.OptionFullWidth(),
+		)
+		if _, err = io.Copy(io.MultiWriter(h, bar), f); err != nil {
+			return
+		}
+	} else {
+		if _, err = io.Copy(h, f); err != nil {
+			return
+		}
+	}
+
+	hashHighway = h.Sum(nil)
+	return
+}
+
+// MD5HashFile returns MD5 hash
+func MD5HashFile(fname string, doShowProgress bool) (hash256 []byte, err error) {
+	f, err := os.Open(fname)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	h := md5.New()
+	if doShowProgress {
+		stat, _ := f.Stat()
+		fnameShort := path.Base(fname)
+		if len(fnameShort) > 20 {
+			fnameShort = fnameShort[:20] + "..."
+		}
+		bar := progressbar.NewOptions64(stat.Size(),
+			progressbar.OptionSetWriter(os.Stderr),
+			progressbar.OptionShowBytes(true),
+			progressbar.OptionSetDescription(fmt.Sprintf("Hashing %s", fnameShort)),
+			progressbar.OptionClearOnFinish(),
+			progressbar.OptionFullWidth(),
+		)
+		if _, err = io.Copy(io.MultiWriter(h, bar), f); err != nil {
+			return
+		}
+	} else {
+		if _, err = io.Copy(h, f); err != nil {
+			return
+		}
+	}
+
+	hash256 = h.Sum(nil)
+	return
+}
+
+// warnSHA1 makes sure the weakness of sha1 is only pointed out once
+var warnSHA1 sync.Once
+
+// SHA1HashFile returns SHA-1 hash, only for receivers that don't
+// understand anything else
+func SHA1HashFile(fname string, doShowProgress bool) (hash []byte, err error) {
+	return HashFileContext(context.Background(), fname, "sha1", doShowProgress)
+}
+
+// SHA512HashFile returns SHA-512 hash
+func SHA512HashFile(fname string, doShowProgress bool) (hash []byte, err error) {
+	return HashFileContext(context.Background(), fname, "sha512", doShowProgress)
+}
+
+var imofull = imohash.NewCustom(0, 0)
+var imopartial = imohash.NewCustom(16*16*8*1024, 128*1024)
+
+// IMOHashFile returns imohash
+func IMOHashFile(fname string) (hash []byte, err error) {
+	b, err := imopartial.SumFile(fname)
+	hash = b[:]
+	return
+}
+
+// IMOHashFileFull returns imohash of full file
+func IMOHashFileFull(fname string) (hash []byte, err error) {
+	b, err := imofull.SumFile(fname)
+	hash = b[:]
+	return
+}
+
+// XXHashFile returns the xxhash of a file
+func XXHashFile(fname string, doShowProgress bool) (hash256 []byte, err error) {
+	f, err := os.Open(fname)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	h := xxhash.New()
+	if doShowProgress {
+		stat, _ := f.Stat()
+		fnameShort := path.Base(fname)
+		if len(fnameShort) > 20 {
+			fnameShort = fnameShort[:20] + "..."
+		}
+		bar := progressbar.NewOptions64(stat.Size(),
+			progressbar.OptionSetWriter(os.Stderr),
+			progressbar.OptionShowBytes(true),
+			progressbar.OptionSetDescription(fmt.Sprintf("Hashing %s", fnameShort)),
+			progressbar.OptionClearOnFinish(),
+			progressbar.OptionFullWidth(),
+		)
+		if _, err = io.Copy(io.MultiWriter(h, bar), f); err != nil {
+			return
+		}
+	} else {
+		if _, err = io.Copy(h, f); err != nil {
+			return
+		}
+	}
+
+	hash256 = h.Sum(nil)
+	return
+}
+
+// newHasher returns a streaming hash for the given algorithm.
+// imohash is not included since it samples the file instead of streaming it.
+func newHasher(algorithm string) (h hash.Hash, err error) {
+	switch algorithm {
+	case "md5":
+		return md5.New(), nil
+	case "sha1":
+		warnSHA1.Do(func() {
+			log.Warn("sha1 is cryptographically weak, prefer another algorithm")
+		})
+		return sha1.New(), nil
+	case "sha512":
+		return sha512.New(), nil
+	case "xxhash":
+		return xxhash.New(), nil
+	case "highway":
+		var key []byte
+		key, err = hex.DecodeString(highwayHashKey)
+		if err != nil {
+			return
+		}
+		h, err = highwayhash.New(key)
+		if err != nil {
+			err = fmt.Errorf("could not create highwayhash: %s", err.Error())
+		}
+		return
+	}
+	err = fmt.Errorf("unspecified algorithm")
+	return
+}
+
+// HashReader returns the hash of everything read from r, like HashFile
+// does for a file. imohash is not supported as it samples a file of known
+// size.
+func HashReader(r io.Reader, algorithm string) (hash []byte, err error) {
+	h, err := newHasher(algorithm)
+	if err != nil {
+		return
+	}
+	if _, err = io.Copy(h, r); err != nil {
+		return
+	}
+	hash = h.Sum(nil)
+	return
+}
+
+// HashFileLogical returns the hash of the first logicalSize bytes of a file,
+// ignoring any trailing padding that the storage layer may have added.
+func HashFileLogical(fname string, algorithm string, logicalSize int64) (hash []byte, err error) {
+	f, err := os.Open(fname)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	stat, err := f.Stat()
+	if err != nil {
+		return
+	}
+	if stat.Size() < logicalSize {
+		err = fmt.Errorf("file %s is smaller (%d) than logical size (%d)", fname, stat.Size(), logicalSize)
+		return
+	}
+	section := io.NewSectionReader(f, 0, logicalSize)
+	if algorithm == "imohash" {
+		var b [imohash.Size]byte
+		b, err = imopartial.SumSectionReader(section)
+		hash = b[:]
+		return
+	}
+	h, err := newHasher(algorithm)
+	if err != nil {
+		return
+	}
+	if _, err = io.Copy(h, section); err != nil {
+		return
+	}
+	hash = h.Sum(nil)
+	return
+}
+
+// ProcessFileChunks reads a file in blocks of chunkSize and calls fn with the
+// offset and content of each one, the last chunk having its true length.
+// The chunk buffer is reused so fn must not retain it after returning.
+// Processing stops at the first error returned by fn.
+func ProcessFileChunks(fname string, chunkSize int, fn func(offset int64, chunk []byte) error) (err error) {
+	if chunkSize <= 0 {
+		return fmt.Errorf("invalid chunk size %d", chunkSize)
+	}
+	f, err := os.Open(fname)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	buffer := make([]byte, chunkSize)
+	var offset int64
+	for {
+		bytesread, errRead := io.ReadFull(f, buffer)
+		if bytesread > 0 {
+			if err = fn(offset, buffer[:bytesread]); err != nil {
+				return
+			}
+			offset += int64(bytesread)
+		}
+		if errRead == io.EOF || errRead == io.ErrUnexpectedEOF {
+			return nil
+		}
+		if errRead != nil {
+			return errRead
+		}
+	}
+}
+
+// SHA256 returns sha256 sum
+func SHA256(s string) string {
+	sha := sha256.New()
+	sha.Write([]byte(s))
+	return hex.EncodeToString(sha.Sum(nil))
+}
+
+// HashEqual reports whether two digests are equal in constant time, so that
+// comparing MAC-like digests doesn't leak how many leading bytes match.
+// Digests of different lengths are never equal.
+func HashEqual(a []byte, b []byte) bool {
+	return subtle.ConstantTimeCompare(a, b) == 1
+}
+
+// ParseChecksumManifest parses a coreutils style checksum file like
+// SHA256SUMS, with lines of "<hex>  <filename>" (text mode) or
+// "<hex> *<filename>" (binary mode), into a map from filename to digest.
+// Blank lines and lines starting with "#" are skipped.
+func ParseChecksumManifest(fname string) (digests map[string][]byte, err error) {
+	f, err := os.Open(fname)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	digests = make(map[string][]byte)
+	scanner := bufio.NewScanner(f)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if strings.TrimSpace(line) == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		hexDigest, name, found := strings.Cut(line, " ")
+		if !found || len(name) < 2 || (name[0] != ' ' && name[0] != '*') {
+			return nil, fmt.Errorf("malformed line %d: '%s'", lineNumber, line)
+		}
+		name = name[1:]
+		digest, errDecode := hex.DecodeString(hexDigest)
+		if errDecode != nil || len(digest) == 0 {
+			return nil, fmt.Errorf("malformed digest on line %d: '%s'", lineNumber, hexDigest)
+		}
+		digests[name] = digest
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, err
+	}
+	return
+}
+
+// publicIPProviders are queried in turn by PublicIP for the public IPv4
+// address, so that one being down doesn't break IP discovery
+var publicIPProviders = []string{
+	"http://ipv4.icanhazip.com",
+	"https://api.ipify.org",
+	"https://v4.ident.me",
+}
+
+// publicIPv6URL is queried by PublicIPv6, replaced in tests
+var publicIPv6URL = "http://ipv6.icanhazip.com"
+
+// publicIPTimeout bounds the public IP queries made without a deadline
+const publicIPTimeout = 10 * time.Second
+
+// PublicIP returns public ip address
+func PublicIP() (ip string, err error) {
+	return PublicIPContext(context.Background())
+}
+
+// PublicIPContext is PublicIP giving up when ctx is done. Without a
+// deadline on ctx, each provider is given 10 seconds.
+func PublicIPContext(ctx context.Context) (ip string, err error) {
+	return publicIPFrom(ctx, publicIPProviders)
+}
+
+// PublicIPFrom returns the first valid ip address returned by the providers,
+// URLs answering with the ip address of the client, which are tried in order.
+// Responses that aren't an ip address, like error pages, are skipped.
+func PublicIPFrom(providers []string) (ip string, err error) {
+	return publicIPFrom(context.Background(), providers)
+}
+
+func publicIPFrom(ctx context.Context, providers []string) (ip string, err error) {
+	if len(providers) == 0 {
+		return "", fmt.Errorf("no public ip providers")
+	}
+	for _, provider := range providers {
+		ip, err = fetchPublicIP(ctx, provider)
+		if err == nil && net.ParseIP(ip) == nil {
+			err = fmt.Errorf("invalid ip address from %s", provider)
+		}
+		if err == nil {
+			return
+		}
+		if ctx.Err() != nil {
+			return "", ctx.Err()
+		}
+		log.Debugf("could not get public ip: %v", err)
+	}
+	return "", err
+}
+
+// PublicIPv6 returns the public IPv6 address, which fails on hosts
+// without IPv6 connectivity
+func PublicIPv6() (ip string, err error) {
+	ip, err = fetchPublicIP(context.Background(), publicIPv6URL)
+	if err != nil {
+		return
+	}
+	if parsed := net.ParseIP(ip); parsed == nil || parsed.To4() != nil {
+		return "", fmt.Errorf("invalid IPv6 address '%s'", ip)
+	}
+	return
+}
+
+// fetchPublicIP returns the trimmed body of the response of url
+func fetchPublicIP(ctx context.Context, url string) (ip string, err error) {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, publicIPTimeout)
+		defer cancel()
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("%s returned %s", url, resp.Status)
+	}
+
+	// read the body of the response
+	// and return the ip address
+	buf := new(bytes.Buffer)
+	if _, err = buf.ReadFrom(resp.Body); err != nil {
+		return
+	}
+	ip = strings.TrimSpace(buf.String())
+	return
+}
+
+// PublicIPs returns the public IPv4 and IPv6 addresses, queried in
+// parallel, leaving empty the ones that couldn't be found. An error is only
+// returned if neither was found.
+func PublicIPs() (ipv4 string, ipv6 string, err error) {
+	var err4, err6 error
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		ipv4, err4 = PublicIP()
+		if err4 == nil && net.ParseIP(ipv4).To4() == nil {
+			ipv4, err4 = "", fmt.Errorf("invalid IPv4 address '%s'", ipv4)
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		ipv6, err6 = PublicIPv6()
+	}()
+	wg.Wait()
+	if err4 != nil && err6 != nil {
+		err = fmt.Errorf("could not get public ip: %v, %v", err4, err6)
+	}
+	return
+}
+
+// ipv6ProbeAddress is a well known IPv6 address (Google public DNS)
+// dialed to check that IPv6 traffic is actually routed
+const ipv6ProbeAddress = "[2001:4860:4860::8888]:53"
+
+// ipv6CacheTTL is how long the result of HasIPv6Connectivity is reused
+const ipv6CacheTTL = 5 * time.Minute
+
+// ipv6Dial dials the IPv6 probe, replaced in tests
+var ipv6Dial = (&net.Dialer{Timeout: 2 * time.Second}).DialContext
+
+var ipv6Connectivity struct {
+	sync.Mutex
+	ok      bool
+	checked time.Time
+}
+
+// HasIPv6Connectivity reports whether the host can actually reach the IPv6
+// internet, which many networks advertise addresses for but don't route, by
+// opening a short TCP connection to a known IPv6 address. The result is
+// cached for a few minutes, unless ctx was cancelled during the probe.
+func HasIPv6Connectivity(ctx context.Context) bool {
+	ipv6Connectivity.Lock()
+	defer ipv6Connectivity.Unlock()
+	if !ipv6Connectivity.checked.IsZero() && time.Since(ipv6Connectivity.checked) < ipv6CacheTTL {
+		return ipv6Connectivity.ok
+	}
+	conn, err := ipv6Dial(ctx, "tcp6", ipv6ProbeAddress)
+	if err != nil {
+		log.Debugf("no ipv6 connectivity: %s", err)
+		if ctx.Err() != nil {
+			return false
+		}
+	} else {
+		conn.Close()
+	}
+	ipv6Connectivity.ok = err == nil
+	ipv6Connectivity.checked = time.Now()
+	return ipv6Connectivity.ok
+}
+
+// LocalIP returns local ip address, or an empty string if it can't be
+// determined
+func LocalIP() string {
+	ip, err := LocalIPErr()
+	if err != nil {
+		log.Error(err)
+	}
+	return ip
+}
+
+// LocalIPErr returns local ip address, i.e. the address of the interface
+// that routes to the internet. No packet is sent.
+func LocalIPErr() (ip string, err error) {
+	conn, err := net.Dial("udp", "8.8.8.8:80")
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	localAddr := conn.LocalAddr().(*net.UDPAddr)
+
+	return localAddr.IP.String(), nil
+}
+
+func GenerateRandomPin() string {
+	s := ""
+	max := new(big.Int)
+	max.SetInt64(9)
+	for i := 0; i < NbPinNumbers; i++ {
+		v, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			panic(err)
+		}
+		s += fmt.Sprintf("%d", v)
+	}
+	return s
+}
+
+// GetRandomName returns mnemonicoded random name
+func GetRandomName() string {
+	var result []string
+	bs := make([]byte, NbBytesWords)
+	rand.Read(bs)
+	result = mnemonicode.EncodeWordList(result, bs)
+	return GenerateRandomPin() + "-" + strings.Join(result, "-")
+}
+
+// TimeBucketedCode returns a code shaped like the ones of GetRandomName,
+// derived from an HMAC of the time bucket containing at keyed with secret,
+// so that both ends sharing the secret and a clock agree on the code
+// without communicating.
+func TimeBucketedCode(secret []byte, bucket time.Duration, at time.Time) (code string, err error) {
+	if bucket <= 0 {
+		return "", fmt.Errorf("invalid bucket %s", bucket)
+	}
+	index := at.UnixNano() / int64(bucket)
+	if at.UnixNano()%int64(bucket) < 0 {
+		index--
+	}
+	mac := hmac.New(sha256.New, secret)
+	binary.Write(mac, binary.BigEndian, index)
+	sum := mac.Sum(nil)
+	pin := ""
+	for _, b := range sum[:NbPinNumbers] {
+		pin += fmt.Sprintf("%d", b%9)
+	}
+	words := mnemonicode.EncodeWordList(nil, sum[NbPinNumbers:NbPinNumbers+NbBytesWords])
+	code = pin + "-" + strings.Join(words, "-")
+	return
+}
+
+// TimeBucketedCodes returns the codes of the bucket containing at and of the
+// previous one, so a code generated just before a bucket boundary is still
+// accepted after it
+func TimeBucketedCodes(secret []byte, bucket time.Duration, at time.Time) (current string, previous string, err error) {
+	if current, err = TimeBucketedCode(secret, bucket, at); err != nil {
+		return
+	}
+	previous, err = TimeBucketedCode(secret, bucket, at.Add(-bucket))
+	return
+}
+
+// NormalizeCode returns the canonical form of a user supplied code:
+// trimmed, lowercased and with whitespace separated words joined by "-"
+func NormalizeCode(code string) string {
+	return strings.Join(strings.Fields(strings.ToLower(code)), "-")
+}
+
+// CodeEqualConstantTime reports whether two codes are equal once normalized,
+// in constant time so that a relay comparing a submitted code doesn't leak
+// timing information. Both codes are hashed first so that inputs of
+// differing lengths are compared in the same time too.
+func CodeEqualConstantTime(a string, b string) bool {
+	hashA := sha256.Sum256([]byte(NormalizeCode(a)))
+	hashB := sha256.Sum256([]byte(NormalizeCode(b)))
+	return subtle.ConstantTimeCompare(hashA[:], hashB[:]) == 1
+}
+
+// CodeSimilarity returns how similar two codes are once normalized, from 0
+// (nothing in common) to 1 (identical), as one minus their Levenshtein
+// distance divided by the length of the longer code.
+func CodeSimilarity(a string, b string) float64 {
+	ra := []rune(NormalizeCode(a))
+	rb := []rune(NormalizeCode(b))
+	longest := max(len(ra), len(rb))
+	if longest == 0 {
+		return 1
+	}
+	return 1 - float64(levenshtein(ra, rb))/float64(longest)
+}
+
+// IsConfusinglySimilar reports whether two codes have a CodeSimilarity of
+// at least threshold, e.g. to reject a custom code that is a near-typo of
+// a reserved one. Identical codes, also once normalized, count as similar.
+func IsConfusinglySimilar(a string, b string, threshold float64) bool {
+	return CodeSimilarity(a, b) >= threshold
+}
+
+// levenshtein returns the edit distance between a and b
+func levenshtein(a []rune, b []rune) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
+
+// SessionFingerprint returns a short phrase of two mnemonic words derived
+// from the SHA-256 of the normalized code, that both ends of a transfer can
+// read out to each other to confirm they share the same code.
+func SessionFingerprint(code string) string {
+	sum := sha256.Sum256([]byte(NormalizeCode(code)))
+	// four bytes encode to three words, the first two
+	// words already carry most of the entropy
+	words := mnemonicode.EncodeWordList(nil, sum[:4])
+	return strings.Join(words[:2], "-")
+}
+
+// ErrWordlistMismatch is returned for a code generated with another wordlist
+var ErrWordlistMismatch = errors.New("this code was generated with a different wordlist")
+
+// WordlistVersion returns a fingerprint of the bundled mnemonicode wordlist,
+// to be persisted next to codes so that a code saved by a version of croc
+// with another wordlist can be told apart from an invalid one
+func WordlistVersion() string {
+	sum := sha256.Sum256([]byte(strings.Join(mnemonicode.WordList, "\n")))
+	return hex.EncodeToString(sum[:8])
+}
+
+// ValidateCodeAgainstWordlistVersion checks a generated code persisted with
+// the given WordlistVersion: an error wrapping ErrWordlistMismatch is
+// returned if the wordlist changed since, otherwise the words of the code
+// following its pin must all be in the wordlist.
+func ValidateCodeAgainstWordlistVersion(code string, version string) error {
+	if current := WordlistVersion(); version != current {
+		return fmt.Errorf("%w (%s, current %s)", ErrWordlistMismatch, version, current)
+	}
+	words := strings.Split(NormalizeCode(code), "-")
+	if len(words) < 2 {
+		return fmt.Errorf("code has no words")
+	}
+	for _, word := range words[1:] {
+		if !mnemonicode.IsWord(word) {
+			return fmt.Errorf("'%s' is not in the wordlist", word)
+		}
+	}
+	return nil
+}
+
+// CodeKind is the format of a transfer code, as returned by ClassifyCode
+type CodeKind int
+
+const (
+	// CodeInvalid is empty or contains control characters
+	CodeInvalid CodeKind = iota
+	// CodeGenerated is a pin followed by wordlist words, like GetRandomName
+	CodeGenerated
+	// CodeCustom is any other valid code, chosen by the user
+	CodeCustom
+)
+
+// ClassifyCode reports whether code looks like one of GetRandomName, was
+// chosen by the user, or isn't usable at all, e.g. to only warn about the
+// entropy of custom codes.
+func ClassifyCode(code string) CodeKind {
+	if strings.TrimSpace(code) == "" {
+		return CodeInvalid
+	}
+	for _, r := range code {
+		if unicode.IsControl(r) {
+			return CodeInvalid
+		}
+	}
+	parts := strings.Split(NormalizeCode(code), "-")
+	if len(parts) < 2 || len(parts[0]) != NbPinNumbers {
+		return CodeCustom
+	}
+	for _, r := range parts[0] {
+		if r < '0' || r > '9' {
+			return CodeCustom
+		}
+	}
+	for _, word := range parts[1:] {
+		if !mnemonicode.IsWord(word) {
+			return CodeCustom
+		}
+	}
+	return CodeGenerated
+}
+
+// confirmationWordsInfo binds the keys derived by ConfirmationWords to
+// their purpose
+const confirmationWordsInfo = "croc confirmation words"
+
+// MaxConfirmationWords is the most words ConfirmationWords derives, HKDF
+// producing at most 255 times the hash size
+const MaxConfirmationWords = 255 * sha256.Size / 4 * 3
+
+// ConfirmationWords derives n mnemonic words from the session key with HKDF,
+// for both ends to read out to each other to rule out a man in the middle.
+// Unlike SessionFingerprint they don't reveal anything about the code.
+// n is capped at MaxConfirmationWords.
+func ConfirmationWords(sessionKey []byte, n int) []string {
+	if n <= 0 {
+		return []string{}
+	}
+	n = min(n, MaxConfirmationWords)
+	// every four bytes encode to three words
+	derived := make([]byte, (n+2)/3*4)
+	kdf := hkdf.New(sha256.New, sessionKey, nil, []byte(confirmationWordsInfo))
+	if _, err := io.ReadFull(kdf, derived); err != nil {
+		// can't fail with n capped
+		panic(err)
+	}
+	return mnemonicode.EncodeWordList(nil, derived)[:n]
+}
+
+// transferTokenVersion is the current version of the TransferToken encoding
+const transferTokenVersion = 1
+
+// TransferToken is a transfer code with the metadata needed to join it,
+// packed by EncodeTransferToken into an opaque string for URLs or QR codes
+type TransferToken struct {
+	Code  string
+	Relay string
+	// Expires is the time after which the token is no longer valid,
+	// the zero time meaning it doesn't expire
+	Expires time.Time
+}
+
+// EncodeTransferToken packs t as base64url (without padding) of a version
+// byte, the length-prefixed code and relay, and the expiry in unix seconds
+func EncodeTransferToken(t TransferToken) (token string, err error) {
+	if t.Code == "" {
+		return "", fmt.Errorf("transfer token needs a code")
+	}
+	b := []byte{transferTokenVersion}
+	for _, field := range []string{t.Code, t.Relay} {
+		if len(field) > math.MaxUint8 {
+			return "", fmt.Errorf("transfer token field too long: %d bytes", len(field))
+		}
+		b = append(b, byte(len(field)))
+		b = append(b, field...)
+	}
+	var expires int64
+	if !t.Expires.IsZero() {
+		expires = t.Expires.Unix()
+	}
+	b = binary.BigEndian.AppendUint64(b, uint64(expires))
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// DecodeTransferToken unpacks a token made by EncodeTransferToken
+func DecodeTransferToken(token string) (t TransferToken, err error) {
+	b, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return t, fmt.Errorf("malformed transfer token: %w", err)
+	}
+	if len(b) == 0 {
+		return t, fmt.Errorf("malformed transfer token: empty")
+	}
+	if b[0] != transferTokenVersion {
+		return t, fmt.Errorf("unknown transfer token version %d", b[0])
+	}
+	b = b[1:]
+	var fields [2]string
+	for i := range fields {
+		if len(b) < 1 || len(b) < 1+int(b[0]) {
+			return t, fmt.Errorf("malformed transfer token: too short")
+		}
+		fields[i] = string(b[1 : 1+int(b[0])])
+		b = b[1+int(b[0]):]
+	}
+	if len(b) != 8 {
+		return t, fmt.Errorf("malformed transfer token: bad length")
+	}
+	t.Code, t.Relay = fields[0], fields[1]
+	if t.Code == "" {
+		return TransferToken{}, fmt.Errorf("malformed transfer token: no code")
+	}
+	if !utf8.ValidString(t.Code) || !utf8.ValidString(t.Relay) {
+		return TransferToken{}, fmt.Errorf("malformed transfer token: invalid utf-8")
+	}
+	if expires := int64(binary.BigEndian.Uint64(b)); expires != 0 {
+		t.Expires = time.Unix(expires, 0)
+	}
+	return
+}
+
+// ByteCountDecimal converts bytes to human readable byte string. Despite
+// its name and its "kB", "MB"... suffixes it uses binary (1024) multiples,
+// it is kept as is for compatibility: use ByteCountIEC or ByteCountSI for
+// correctly labelled sizes.
+func ByteCountDecimal(b int64) string {
+	const unit = 1024
+	if b < unit {
+		return fmt.Sprintf("%d B", b)
+	}
+	div, exp := int64(unit), 0
+	for n := b / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %cB", float64(b)/float64(div), "kMGTPE"[exp])
+}
+
+// connectionWindow is the number of bytes in flight assumed for a single
+// TCP connection, a common default receive window
+const connectionWindow = 256 * 1024
+
+// maxConnections is the largest number of connections recommended
+const maxConnections = 16
+
+// RecommendConnectionCount suggests how many parallel connections fill a
+// link, from the bandwidth-delay product: the bytes in flight needed are
+// bandwidth * rtt, and each connection carries about one 256 KiB window, so
+//
+//	connections = ceil(bandwidthBytesPerSec * rttMillis / 1000 / 256 KiB)
+//
+// clamped to 1-16. Unknown (non-positive) measurements give 1.
+func RecommendConnectionCount(bandwidthBytesPerSec float64, rttMillis float64) int {
+	if !(bandwidthBytesPerSec > 0) || !(rttMillis > 0) {
+		return 1
+	}
+	bdp := bandwidthBytesPerSec * rttMillis / 1000
+	connections := math.Ceil(bdp / connectionWindow)
+	if connections < 1 {
+		return 1
+	}
+	if connections > maxConnections {
+		return maxConnections
+	}
+	return int(connections)
+}
+
+// ByteCountIEC converts bytes to a human readable string in binary
+// multiples of 1024 with IEC suffixes, like "1.5 MiB"
+func ByteCountIEC(b int64) string {
+	const unit = 1024
+	if b < unit {
+		return fmt.Sprintf("%d B", b)
+	}
+	div, exp := int64(unit), 0
+	for n := b / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(b)/float64(div), "KMGTPE"[exp])
+}
+
+// ByteCountSI converts bytes to a human readable string in decimal
+// multiples of 1000 with SI suffixes, like "1.5 MB"
+func ByteCountSI(b int64) string {
+	const unit = 1000
+	if b < unit {
+		return fmt.Sprintf("%d B", b)
+	}
+	div, exp := int64(unit), 0
+	for n := b / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %cB", float64(b)/float64(div), "kMGTPE"[exp])
+}
+
+// FormatDuration converts a duration to a compact human readable string
+// with at most two units, like "850ms", "45s", "2m", "1m5s" or "1h2m"
+func FormatDuration(d time.Duration) string {
+	sign, abs := "", uint64(d)
+	if d < 0 {
+		// negated as unsigned so that math.MinInt64 doesn't overflow
+		sign, abs = "-", -abs
+	}
+	if abs < uint64(time.Second) {
+		return fmt.Sprintf("%s%dms", sign, abs/uint64(time.Millisecond))
+	}
+	units := []struct {
+		value  uint64
+		suffix string
+	}{
+		{abs / uint64(time.Hour), "h"},
+		{abs % uint64(time.Hour) / uint64(time.Minute), "m"},
+		{abs % uint64(time.Minute) / uint64(time.Second), "s"},
+	}
+	// skip the leading zero units
+	for units[0].value == 0 {
+		units = units[1:]
+	}
+	s := fmt.Sprintf("%s%d%s", sign, units[0].value, units[0].suffix)
+	if len(units) > 1 && units[1].value > 0 {
+		s += fmt.Sprintf("%d%s", units[1].value, units[1].suffix)
+	}
+	return s
+}
+
+// EWMARate tracks an exponentially weighted moving average of a transfer
+// rate, giving a stable ETA on bursty networks. It is safe for concurrent use.
+type EWMARate struct {
+	sync.Mutex
+	alpha   float64
+	rate    float64
+	hasRate bool
+	last    time.Time
+	pending int64
+}
+
+// NewEWMARate returns an EWMARate where alpha (0 < alpha <= 1) is the weight
+// of each new sample, smaller values smoothing more
+func NewEWMARate(alpha float64) *EWMARate {
+	if alpha <= 0 || alpha > 1 {
+		alpha = 0.1
+	}
+	return &EWMARate{alpha: alpha}
+}
+
+// Update records that bytes were transferred since the previous update at
+// time at. The first update only sets the starting time.
+func (e *EWMARate) Update(bytes int64, at time.Time) {
+	e.Lock()
+	defer e.Unlock()
+	if e.last.IsZero() {
+		e.last = at
+		return
+	}
+	elapsed := at.Sub(e.last).Seconds()
+	if elapsed <= 0 {
+		e.pending += bytes
+		return
+	}
+	instant := float64(bytes+e.pending) / elapsed
+	if e.hasRate {
+		e.rate = e.alpha*instant + (1-e.alpha)*e.rate
+	} else {
+		e.rate = instant
+		e.hasRate = true
+	}
+	e.pending = 0
+	e.last = at
+}
+
+// Rate returns the smoothed rate in bytes per second
+func (e *EWMARate) Rate() float64 {
+	e.Lock()
+	defer e.Unlock()
+	return e.rate
+}
+
+// ETA returns the estimated time to transfer remaining bytes at the
+// smoothed rate, or 0 if the rate is not known yet
+func (e *EWMARate) ETA(remaining int64) time.Duration {
+	rate := e.Rate()
+	if rate <= 0 || remaining <= 0 {
+		return 0
+	}
+	return time.Duration(float64(remaining) / rate * float64(time.Second))
+}
+
+// TransferSummary holds the statistics of a finished transfer
+type TransferSummary struct {
+	FileCount  int
+	TotalBytes int64
+	Duration   time.Duration
+	Algorithm  string
+	Verified   bool
+}
+
+// String returns a multi-line, human readable summary of the transfer
+func (s TransferSummary) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Files: %d\n", s.FileCount)
+	fmt.Fprintf(&b, "Size: %s\n", ByteCountDecimal(s.TotalBytes))
+	fmt.Fprintf(&b, "Duration: %s\n", FormatDuration(s.Duration))
+	if s.Duration > 0 {
+		rate := int64(float64(s.TotalBytes) / s.Duration.Seconds())
+		fmt.Fprintf(&b, "Average rate: %s/s\n", ByteCountDecimal(rate))
+	} else {
+		fmt.Fprintf(&b, "Average rate: -\n")
+	}
+	verified := "not verified"
+	if s.Verified {
+		verified = "verified"
+	}
+	fmt.Fprintf(&b, "Hash: %s (%s)", s.Algorithm, verified)
+	return b.String()
+}
+
+// MissingChunks returns the positions of missing chunks.
+// If file doesn't exist, it returns an empty chunk list (all chunks).
+// If the file size is not the same as requested, it returns an empty chunk list (all chunks).
+func MissingChunks(fname string, fsize int64, chunkSize int) (chunkRanges []int64) {
+	f, err := os.Open(fname)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	fstat, err := os.Stat(fname)
+	if err != nil || fstat.Size() != fsize {
+		return
+	}
+
+	emptyBuffer := make([]byte, chunkSize)
+	chunkNum := 0
+	chunks := make([]int64, int64(math.Ceil(float64(fsize)/float64(chunkSize))))
+	var currentLocation int64
+	for {
+		buffer := make([]byte, chunkSize)
+		bytesread, err := f.Read(buffer)
+		if err != nil {
+			break
+		}
+		if bytes.Equal(buffer[:bytesread], emptyBuffer[:bytesread]) {
+			chunks[chunkNum] = currentLocation
+			chunkNum++
+		}
+		currentLocation += int64(bytesread)
+	}
+	if chunkNum == 0 {
+		chunkRanges = []int64{}
+	} else {
+		chunks = chunks[:chunkNum]
+		chunkRanges = []int64{int64(chunkSize), chunks[0]}
+		curCount := 0
+		for i, chunk := range chunks {
+			if i == 0 {
+				continue
+			}
+			curCount++
+			if chunk-chunks[i-1] > int64(chunkSize) {
+				chunkRanges = append(chunkRanges, int64(curCount))
+				chunkRanges = append(chunkRanges, chunk)
+				curCount = 0
+			}
+		}
+		chunkRanges = append(chunkRanges, int64(curCount+1))
+	}
+	return
+}
+
+// ChunkRangesToChunks converts chunk ranges to list. If maxFileSize is
+// given, ranges that fail ValidateChunkRanges give no chunks.
+func ChunkRangesToChunks(chunkRanges []int64, maxFileSize ...int64) (chunks []int64) {
+	if len(chunkRanges) == 0 {
+		return
+	}
+	if len(maxFileSize) > 0 {
+		if err := ValidateChunkRanges(chunkRanges, maxFileSize[0]); err != nil {
+			log.Warnf("ignoring chunk ranges: %v", err)
+			return
+		}
+	}
+	chunkSize := chunkRanges[0]
+	chunks = []int64{}
+	for i := 1; i < len(chunkRanges); i += 2 {
+		for j := int64(0); j < (chunkRanges[i+1]); j++ {
+			chunks = append(chunks, chunkRanges[i]+j*chunkSize)
+		}
+	}
+	return
+}
+
+// ValidateChunkRanges checks chunk ranges received from a peer before they
+// are expanded: they must be well formed and every chunk must start within
+// a file of maxFileSize bytes, which bounds the number of chunks.
+func ValidateChunkRanges(chunkRanges []int64, maxFileSize int64) error {
+	if len(chunkRanges) == 0 {
+		return nil
+	}
+	if len(chunkRanges)%2 != 1 {
+		return fmt.Errorf("invalid chunk ranges length %d", len(chunkRanges))
+	}
+	chunkSize := chunkRanges[0]
+	if chunkSize <= 0 {
+		return fmt.Errorf("invalid chunk size %d", chunkSize)
+	}
+	var total int64
+	maxChunks := maxFileSize/chunkSize + 1
+	for i := 1; i < len(chunkRanges); i += 2 {
+		start, count := chunkRanges[i], chunkRanges[i+1]
+		if start < 0 || count < 0 {
+			return fmt.Errorf("invalid chunk range %d+%d", start, count)
+		}
+		if count == 0 {
+			continue
+		}
+		if start >= maxFileSize || count > (maxFileSize-start+chunkSize-1)/chunkSize {
+			return fmt.Errorf("chunk range %d+%d exceeds file size %d", start, count, maxFileSize)
+		}
+		if total += count; total > maxChunks {
+			return fmt.Errorf("chunk ranges have more than %d chunks", maxChunks)
+		}
+	}
+	return nil
+}
+
+// ByteRange is a range of Length bytes starting at offset Start
+type ByteRange struct {
+	Start  int64
+	Length int64
+}
+
+// PendingRanges returns the ordered byte ranges of a partially received file
+// that still have to be fetched, coalescing adjacent missing chunks as
+// MissingChunks does. The last range is clamped to fsize.
+func PendingRanges(fname string, fsize int64, chunkSize int) (ranges []ByteRange, err error) {
+	if chunkSize <= 0 {
+		return nil, fmt.Errorf("invalid chunk size %d", chunkSize)
+	}
+	ranges = []ByteRange{}
+	chunkRanges := MissingChunks(fname, fsize, chunkSize)
+	if chunkRanges == nil {
+		// the file is absent or has the wrong size, everything is pending
+		if fsize > 0 {
+			ranges = append(ranges, ByteRange{Start: 0, Length: fsize})
+		}
+		return
+	}
+	for i := 1; i+1 < len(chunkRanges); i += 2 {
+		start := chunkRanges[i]
+		length := chunkRanges[i+1] * chunkRanges[0]
+		if start+length > fsize {
+			length = fsize - start
+		}
+		ranges = append(ranges, ByteRange{Start: start, Length: length})
+	}
+	return
+}
+
+// PreallocateFile creates fname if needed and reserves size bytes for it on
+// disk, so that chunks received out of order don't fragment it and a full
+// disk is reported before the transfer starts. Existing content within size
+// is kept, a larger file is truncated to size.
+func PreallocateFile(fname string, size int64) (err error) {
+	if size < 0 {
+		return fmt.Errorf("invalid size %d", size)
+	}
+	f, err := os.OpenFile(fname, os.O_WRONLY|os.O_CREATE, 0o666)
+	if err != nil {
+		return
+	}
+	defer func() {
+		if errClose := f.Close(); err == nil {
+			err = errClose
+		}
+	}()
+	stat, err := f.Stat()
+	if err != nil {
+		return
+	}
+	if stat.Size() > size {
+		if err = f.Truncate(size); err != nil {
+			return
+		}
+	}
+	if size == 0 {
+		return
+	}
+	err = preallocate(f, size)
+	return
+}
+
+// BlockAlignedChunkSize rounds desired up to a multiple of the block size
+// of the filesystem holding path, or of its directory if path doesn't exist
+// yet, so that chunks are read and written on block boundaries. The desired
+// size is returned unchanged if the block size can't be determined.
+func BlockAlignedChunkSize(path string, desired int) (chunkSize int, err error) {
+	if desired <= 0 {
+		return 0, fmt.Errorf("invalid chunk size %d", desired)
+	}
+	if _, err = os.Stat(path); os.IsNotExist(err) {
+		path = filepath.Dir(path)
+	}
+	size, err := blockSize(path)
+	if err != nil {
+		return
+	}
+	if size <= 0 || size > math.MaxInt32 {
+		return desired, nil
+	}
+	block := int(size)
+	chunkSize = (desired + block - 1) / block * block
+	return
+}
+
+// ResumeState is what has been received of a file, persisted in the cache
+// directory so a transfer can be resumed after a restart
+type ResumeState struct {
+	TotalSize int64 `json:"total_size"`
+	ChunkSize int   `json:"chunk_size"`
+	// Bitset has the present chunks, as returned by ChunkBitset
+	Bitset []byte `json:"bitset"`
+	// Hash is the expected hash of the complete file
+	Hash []byte `json:"hash,omitempty"`
+}
+
+// resumeStateFile returns where the resume state of a transfer code is kept,
+// named after the hash of the code so the code itself is not stored
+func resumeStateFile(code string) (fname string, err error) {
+	cacheDir, err := GetCacheDir()
+	if err != nil {
+		return
+	}
+	sum := sha256.Sum256([]byte(NormalizeCode(code)))
+	return filepath.Join(cacheDir, fmt.Sprintf("resume-%x.json", sum[:16])), nil
+}
+
+// Save atomically writes the state for the transfer code
+func (s *ResumeState) Save(code string) (err error) {
+	fname, err := resumeStateFile(code)
+	if err != nil {
+		return
+	}
+	data, err := json.Marshal(s)
+	if err != nil {
+		return
+	}
+	return writeFileAtomic(fname, data, 0o600)
+}
+
+// LoadResumeState reads the state saved for the transfer code
+func LoadResumeState(code string) (s *ResumeState, err error) {
+	fname, err := resumeStateFile(code)
+	if err != nil {
+		return
+	}
+	data, err := os.ReadFile(fname)
+	if err != nil {
+		return
+	}
+	s = &ResumeState{}
+	if err = json.Unmarshal(data, s); err != nil {
+		return nil, fmt.Errorf("could not parse resume state: %w", err)
+	}
+	if err = s.Validate(s.TotalSize, s.ChunkSize); err != nil {
+		return nil, err
+	}
+	return
+}
+
+// Validate returns an error if the state doesn't describe a file of
+// totalSize received in chunks of chunkSize, in which case the transfer
+// has to restart from scratch
+func (s *ResumeState) Validate(totalSize int64, chunkSize int) error {
+	if s.TotalSize != totalSize {
+		return fmt.Errorf("resume state is for %d bytes, not %d", s.TotalSize, totalSize)
+	}
+	if s.ChunkSize != chunkSize || chunkSize <= 0 {
+		return fmt.Errorf("resume state is for chunks of %d bytes, not %d", s.ChunkSize, chunkSize)
+	}
+	numChunks := (totalSize + int64(chunkSize) - 1) / int64(chunkSize)
+	if int64(len(s.Bitset)) != (numChunks+7)/8 {
+		return fmt.Errorf("resume state has a bitset of %d bytes for %d chunks", len(s.Bitset), numChunks)
+	}
+	return nil
+}
+
+// ZeroFillRatio returns the fraction of the chunks of a file that only
+// hold zeros. The more there are, the less MissingChunks can tell missing
+// chunks from received ones, so a high ratio calls for tracking received
+// chunks with a bitset instead.
+func ZeroFillRatio(fname string, chunkSize int) (ratio float64, err error) {
+	if chunkSize <= 0 {
+		return 0, fmt.Errorf("invalid chunk size %d", chunkSize)
+	}
+	var chunks, zeroChunks int
+	emptyBuffer := make([]byte, chunkSize)
+	err = ProcessFileChunks(fname, chunkSize, func(offset int64, chunk []byte) error {
+		chunks++
+		if bytes.Equal(chunk, emptyBuffer[:len(chunk)]) {
+			zeroChunks++
+		}
+		return nil
+	})
+	if err != nil || chunks == 0 {
+		return
+	}
+	ratio = float64(zeroChunks) / float64(chunks)
+	return
+}
+
+// ResumeOffset returns where to resume a contiguous download of a file of
+// expectedSize: the size of the partial file, or 0 if it doesn't exist yet.
+// A file larger than expected is an error, the download must restart.
+func ResumeOffset(fname string, expectedSize int64) (offset int64, err error) {
+	fstat, err := os.Stat(fname)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return
+	}
+	if !fstat.Mode().IsRegular() {
+		return 0, fmt.Errorf("'%s' is not a regular file", fname)
+	}
+	if fstat.Size() > expectedSize {
+		return 0, fmt.Errorf("'%s' is larger (%d) than expected (%d)", fname, fstat.Size(), expectedSize)
+	}
+	return fstat.Size(), nil
+}
+
+// MissingByteRanges returns HTTP Range header values ("bytes=start-end",
+// with an inclusive end) for each contiguous missing region of a file, so
+// that only the missing bytes need to be requested from a mirror.
+func MissingByteRanges(fname string, fsize int64, chunkSize int) (headers []string, err error) {
+	ranges, err := PendingRanges(fname, fsize, chunkSize)
+	if err != nil {
+		return
+	}
+	headers = make([]string, len(ranges))
+	for i, r := range ranges {
+		headers[i] = fmt.Sprintf("bytes=%d-%d", r.Start, r.Start+r.Length-1)
+	}
+	return
+}
+
+// ChunkBitset returns a packed bitset of the chunks of a file where bit i
+// (bit i%8 of byte i/8) is set if chunk i is present, using the same
+// non-zero content heuristic as MissingChunks. If the file doesn't exist or
+// its size is not the same as requested, no chunks are present.
+func ChunkBitset(fname string, fsize int64, chunkSize int) (bitset []byte, err error) {
+	if chunkSize <= 0 {
+		return nil, fmt.Errorf("invalid chunk size %d", chunkSize)
+	}
+	numChunks := (fsize + int64(chunkSize) - 1) / int64(chunkSize)
+	bitset = make([]byte, (numChunks+7)/8)
+	fstat, err := os.Stat(fname)
+	if err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+			return
+		}
+		return nil, err
+	}
+	if fstat.Size() != fsize {
+		return
+	}
+	f, err := os.Open(fname)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	emptyBuffer := make([]byte, chunkSize)
+	buffer := make([]byte, chunkSize)
+	for i := int64(0); i < numChunks; i++ {
+		bytesread, errRead := io.ReadFull(f, buffer)
+		if errRead != nil && errRead != io.ErrUnexpectedEOF {
+			return nil, errRead
+		}
+		if !bytes.Equal(buffer[:bytesread], emptyBuffer[:bytesread]) {
+			bitset[i/8] |= 1 << (i % 8)
+		}
+	}
+	return
+}
+
+// ChunkBitsetHas reports whether bit i is set in bitset
+func ChunkBitsetHas(bitset []byte, i int64) bool {
+	if i < 0 || i/8 >= int64(len(bitset)) {
+		return false
+	}
+	return bitset[i/8]&(1<<(i%8)) != 0
+}
+
+// ChunkBitsetPresent returns the indices of the set bits among the
+// first numChunks bits of bitset
+func ChunkBitsetPresent(bitset []byte, numChunks int64) (indices []int64) {
+	indices = []int64{}
+	for i := int64(0); i < numChunks; i++ {
+		if ChunkBitsetHas(bitset, i) {
+			indices = append(indices, i)
+		}
+	}
+	return
+}
+
+// ChunkBitsetMissing returns the indices of the unset bits among the
+// first numChunks bits of bitset
+func ChunkBitsetMissing(bitset []byte, numChunks int64) (indices []int64) {
+	indices = []int64{}
+	for i := int64(0); i < numChunks; i++ {
+		if !ChunkBitsetHas(bitset, i) {
+			indices = append(indices, i)
+		}
+	}
+	return
+}
+
+// ChunksToServe returns the indices of the chunks set in localBitset but
+// not in peerBitset, i.e. the chunks this node can serve to the peer.
+// Both bitsets must describe the same file and so have the same length.
+func ChunksToServe(localBitset []byte, peerBitset []byte) (indices []int64, err error) {
+	if len(localBitset) != len(peerBitset) {
+		err = fmt.Errorf("bitset lengths differ: %d != %d", len(localBitset), len(peerBitset))
+		return
+	}
+	indices = []int64{}
+	for i := range localBitset {
+		diff := localBitset[i] &^ peerBitset[i]
+		for bit := 0; diff != 0; bit++ {
+			if diff&1 != 0 {
+				indices = append(indices, int64(i*8+bit))
+			}
+			diff >>= 1
+		}
+	}
+	return
+}
+
+// ChunkHashes returns the xxhash of each chunkSize block of a file,
+// the last one covering the final partial chunk
+func ChunkHashes(fname string, chunkSize int) (hashes []uint64, err error) {
+	hashes = []uint64{}
+	err = ProcessFileChunks(fname, chunkSize, func(offset int64, chunk []byte) error {
+		hashes = append(hashes, xxhash.Sum64(chunk))
+		return nil
+	})
+	if err != nil {
+		hashes = nil
+	}
+	return
+}
+
+// ChunkInfo is the position and digest of a chunk of a stream
+type ChunkInfo struct {
+	Offset int64
+	Length int64
+	Hash   []byte
+}
+
+// StreamChunkManifest reads r once and returns the digest of each chunkSize
+// block along with a rollup digest of the concatenated chunk digests, both
+// using algorithm. It works on any reader, like a network stream.
+func StreamChunkManifest(r io.Reader, chunkSize int, algorithm string) (chunks []ChunkInfo, rollup []byte, err error) {
+	if chunkSize <= 0 {
+		return nil, nil, fmt.Errorf("invalid chunk size %d", chunkSize)
+	}
+	rollupHash, err := newHasher(algorithm)
+	if err != nil {
+		return
+	}
+	chunkHash, err := newHasher(algorithm)
+	if err != nil {
+		return
+	}
+	chunks = []ChunkInfo{}
+	buffer := make([]byte, chunkSize)
+	var offset int64
+	for {
+		bytesread, errRead := io.ReadFull(r, buffer)
+		if bytesread > 0 {
+			chunkHash.Reset()
+			chunkHash.Write(buffer[:bytesread])
+			digest := chunkHash.Sum(nil)
+			rollupHash.Write(digest)
+			chunks = append(chunks, ChunkInfo{Offset: offset, Length: int64(bytesread), Hash: digest})
+			offset += int64(bytesread)
+		}
+		if errRead == io.EOF || errRead == io.ErrUnexpectedEOF {
+			break
+		}
+		if errRead != nil {
+			return nil, nil, errRead
+		}
+	}
+	rollup = rollupHash.Sum(nil)
+	return
+}
+
+// ValidatePresentChunks hashes each present (non-zero, as in MissingChunks)
+// chunk of a partially received file and returns the indices of those whose
+// xxhash doesn't match expected (see ChunkHashes), so that a resume doesn't
+// build on corrupt data.
+func ValidatePresentChunks(fname string, fsize int64, chunkSize int, expected []uint64) (corrupt []int64, err error) {
+	if chunkSize <= 0 {
+		return nil, fmt.Errorf("invalid chunk size %d", chunkSize)
+	}
+	stat, err := os.Stat(fname)
+	if err != nil {
+		return
+	}
+	if stat.Size() != fsize {
+		return nil, fmt.Errorf("file size %d is not the expected %d", stat.Size(), fsize)
+	}
+	if numChunks := (fsize + int64(chunkSize) - 1) / int64(chunkSize); int64(len(expected)) != numChunks {
+		return nil, fmt.Errorf("expected %d chunk hashes, got %d", numChunks, len(expected))
+	}
+	corrupt = []int64{}
+	emptyBuffer := make([]byte, chunkSize)
+	err = ProcessFileChunks(fname, chunkSize, func(offset int64, chunk []byte) error {
+		if bytes.Equal(chunk, emptyBuffer[:len(chunk)]) {
+			return nil
+		}
+		i := offset / int64(chunkSize)
+		if xxhash.Sum64(chunk) != expected[i] {
+			corrupt = append(corrupt, i)
+		}
+		return nil
+	})
+	if err != nil {
+		corrupt = nil
+	}
+	return
+}
+
+// ChunkVerifier checks data as it is received against the expected xxhash
+// of each chunk (see ChunkHashes), failing as soon as a chunk is corrupt
+type ChunkVerifier struct {
+	expected  []uint64
+	chunkSize int
+	chunk     int
+	h         *xxhash.Digest
+	n         int
+	err       error
+}
+
+// NewChunkVerifier returns a ChunkVerifier for the expected chunk hashes.
+// If chunkSize is not positive, every Write and Close fails.
+func NewChunkVerifier(expected []uint64, chunkSize int) *ChunkVerifier {
+	v := &ChunkVerifier{expected: expected, chunkSize: chunkSize, h: xxhash.New()}
+	if chunkSize <= 0 {
+		v.err = fmt.Errorf("invalid chunk size %d", chunkSize)
+	}
+	return v
+}
+
+// Write hashes p, returning an error naming the chunk index as soon as a
+// completed chunk doesn't match its expected hash
+func (v *ChunkVerifier) Write(p []byte) (n int, err error) {
+	if v.err != nil {
+		return 0, v.err
+	}
+	for len(p) > 0 {
+		if v.chunk >= len(v.expected) {
+			v.err = fmt.Errorf("unexpected data after chunk %d", len(v.expected)-1)
+			return n, v.err
+		}
+		toWrite := min(len(p), v.chunkSize-v.n)
+		v.h.Write(p[:toWrite])
+		v.n += toWrite
+		n += toWrite
+		p = p[toWrite:]
+		if v.n == v.chunkSize {
+			if err = v.check(); err != nil {
+				return
+			}
+		}
+	}
+	return
+}
+
+// Close verifies the final partial chunk and that no chunk is missing
+func (v *ChunkVerifier) Close() error {
+	if v.err != nil {
+		return v.err
+	}
+	if v.n > 0 {
+		if err := v.check(); err != nil {
+			return err
+		}
+	}
+	if v.chunk != len(v.expected) {
+		v.err = fmt.Errorf("received %d of %d chunks", v.chunk, len(v.expected))
+	}
+	return v.err
+}
+
+// check compares the hash of the current chunk and moves to the next one
+func (v *ChunkVerifier) check() error {
+	if v.h.Sum64() != v.expected[v.chunk] {
+		v.err = fmt.Errorf("chunk %d is corrupt", v.chunk)
+		return v.err
+	}
+	v.chunk++
+	v.n = 0
+	v.h.Reset()
+	return nil
+}
+
+// NextChunkBatch splits an expanded list of missing chunks (as returned by
+// ChunkRangesToChunks) into a batch of at most maxBatch chunks and the
+// remaining chunks, so chunks can be requested in bounded windows.
+// A maxBatch <= 0 returns all the chunks in one batch.
+func NextChunkBatch(missing []int64, maxBatch int) (batch []int64, remaining []int64) {
+	if maxBatch <= 0 || maxBatch >= len(missing) {
+		return missing, []int64{}
+	}
+	return missing[:maxBatch:maxBatch], missing[maxBatch:]
+}
+
+// interfaceAddresses is net.InterfaceAddrs, replaced in tests
+var interfaceAddresses = net.InterfaceAddrs
+
+// GetLocalIPs returns all local ips
+func GetLocalIPs() (ips []string, err error) {
+	addrs, err := interfaceAddresses()
+	if err != nil {
+		return
+	}
+	ips = []string{}
+	for _, address := range addrs {
+		// check the address type and if it is not a loopback the display it
+		if ipnet, ok := address.(*net.IPNet); ok && !ipnet.IP.IsLoopback() {
+			if ipnet.IP.To4() != nil {
+				ips = append(ips, ipnet.IP.String())
+			}
+		}
+	}
+	return
+}
+
+// GetLocalIPsSorted returns the local ips of GetLocalIPs in a stable
+// order, the private LAN addresses most likely to reach a peer first, then
+// the others, each in numeric order
+func GetLocalIPsSorted() (ips []string, err error) {
+	if ips, err = GetLocalIPs(); err != nil {
+		return
+	}
+	sort.SliceStable(ips, func(i, j int) bool {
+		a, b := net.ParseIP(ips[i]), net.ParseIP(ips[j])
+		if privateA, privateB := IsPrivateIP(a), IsPrivateIP(b); privateA != privateB {
+			return privateA
+		}
+		return bytes.Compare(a.To16(), b.To16()) < 0
+	})
+	return
+}
+
+// IsPrivateIP reports whether ip is in a private range, RFC 1918 for IPv4
+// or RFC 4193 for IPv6
+func IsPrivateIP(ip net.IP) bool {
+	return ip.IsPrivate()
+}
+
+// LANAddress is an address of a LANInterface
+type LANAddress struct {
+	IP net.IP
+	// Private is set if IP is in a private range, i.e. likely on a LAN
+	Private bool
+}
+
+// LANInterface is a network interface that a LAN relay can listen on
+type LANInterface struct {
+	Name      string
+	Addresses []LANAddress
+}
+
+// interfaceAddrs is a network interface with its addresses
+type interfaceAddrs struct {
+	iface net.Interface
+	addrs []net.Addr
+}
+
+// listInterfaces returns the network interfaces of the host, replaced in tests
+var listInterfaces = func() (ifaces []interfaceAddrs, err error) {
+	netIfaces, err := net.Interfaces()
+	if err != nil {
+		return
+	}
+	for _, iface := range netIfaces {
+		var addrs []net.Addr
+		addrs, err = iface.Addrs()
+		if err != nil {
+			return nil, err
+		}
+		ifaces = append(ifaces, interfaceAddrs{iface: iface, addrs: addrs})
+	}
+	return
+}
+
+// LANInterfaces returns the interfaces that are up and not loopback, with
+// their IPv4 and IPv6 addresses, link-local ones excluded
+func LANInterfaces() (lanIfaces []LANInterface, err error) {
+	ifaces, err := listInterfaces()
+	if err != nil {
+		return
+	}
+	lanIfaces = []LANInterface{}
+	for _, iface := range ifaces {
+		if iface.iface.Flags&net.FlagUp == 0 || iface.iface.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		lanIface := LANInterface{Name: iface.iface.Name}
+		for _, addr := range iface.addrs {
+			ipnet, ok := addr.(*net.IPNet)
+			if !ok || ipnet.IP.IsLoopback() || ipnet.IP.IsLinkLocalUnicast() {
+				continue
+			}
+			lanIface.Addresses = append(lanIface.Addresses, LANAddress{IP: ipnet.IP, Private: IsPrivateIP(ipnet.IP)})
+		}
+		if len(lanIface.Addresses) > 0 {
+			lanIfaces = append(lanIfaces, lanIface)
+		}
+	}
+	return
+}
+
+func RandomFileName() (fname string, err error) {
+	f, err := os.CreateTemp(".", "croc-stdin-")
+	if err != nil {
+		return
+	}
+	fname = f.Name()
+	_ = f.Close()
+	return
+}
+
+// tempDirs returns the directories that croc writes temporary files to:
+// the system temp dir and the current directory used by RandomFileName
+var tempDirs = func() []string {
+	return []string{os.TempDir(), "."}
+}
+
+// CheckTempWritable makes sure temporary files can be created, so that an
+// unwritable TMPDIR is reported at startup instead of mid-transfer
+func CheckTempWritable() error {
+	for _, dir := range tempDirs() {
+		if err := probeWritable(dir); err != nil {
+			return fmt.Errorf("temporary directory '%s' is not writable: %w", dir, err)
+		}
+	}
+	return nil
+}
+
+// CheckWritableDir creates dir if needed and makes sure files can be
+// written in it, so that a destination a transfer can't be saved to is
+// reported before the transfer starts instead of after it
+func CheckWritableDir(dir string) (err error) {
+	if err = os.MkdirAll(dir, os.ModePerm); err == nil {
+		err = probeWritable(dir)
+	}
+	if err == nil {
+		return
+	}
+	reason := err.Error()
+	switch {
+	case errors.Is(err, syscall.EROFS):
+		reason = "read-only file system"
+	case errors.Is(err, os.ErrPermission):
+		reason = "permission denied"
+	}
+	return fmt.Errorf("directory '%s' is not writable: %s: %w", dir, reason, err)
+}
+
+// IsCaseInsensitiveFS reports whether the filesystem of dir treats names
+// differing only in case as the same file, by creating two such probe files
+// in dir and checking whether they collide
+func IsCaseInsensitiveFS(dir string) (insensitive bool, err error) {
+	f, err := os.CreateTemp(dir, ".croc-case-")
+	if err != nil {
+		return
+	}
+	lower := f.Name()
+	defer os.Remove(lower)
+	if err = f.Close(); err != nil {
+		return
+	}
+	upper := filepath.Join(dir, strings.ToUpper(filepath.Base(lower)))
+	f, err = os.OpenFile(upper, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if os.IsExist(err) {
+		return true, nil
+	}
+	if err != nil {
+		return
+	}
+	f.Close()
+	return false, os.Remove(upper)
+}
+
+// MeasureWriteSpeed writes and syncs a temporary probe file of probeBytes
+// in dir, then removes it, and returns the measured write throughput so the
+// chunk size can be matched to the speed of the destination storage
+func MeasureWriteSpeed(dir string, probeBytes int64) (bytesPerSecond float64, err error) {
+	if probeBytes <= 0 {
+		return 0, fmt.Errorf("invalid probe size %d", probeBytes)
+	}
+	f, err := os.CreateTemp(dir, ".croc-speed-")
+	if err != nil {
+		return
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	buffer := make([]byte, min(probeBytes, 1024*1024))
+	rand.Read(buffer)
+	start := time.Now()
+	for written := int64(0); written < probeBytes; {
+		n := int64(len(buffer))
+		if probeBytes-written < n {
+			n = probeBytes - written
+		}
+		if _, err = f.Write(buffer[:n]); err != nil {
+			return
+		}
+		written += n
+	}
+	if err = f.Sync(); err != nil {
+		return
+	}
+	elapsed := time.Since(start)
+	if elapsed <= 0 {
+		elapsed = time.Nanosecond
+	}
+	bytesPerSecond = float64(probeBytes) / elapsed.Seconds()
+	return
+}
+
+// probeWritable creates and removes a probe file in dir
+func probeWritable(dir string) (err error) {
+	f, err := os.CreateTemp(dir, ".croc-probe-")
+	if err != nil {
+		return
+	}
+	fname := f.Name()
+	if err = f.Close(); err != nil {
+		os.Remove(fname)
+		return
+	}
+	return os.Remove(fname)
+}
+
+// defaultPortScan is how many ports FindOpenPorts checks at most
+const defaultPortScan = 200
+
+// FindOpenPorts returns up to numPorts ports of host, starting from
+// portNumStart, that nothing listens on. Only the 200 ports from
+// portNumStart are checked, see FindOpenPortsRange to check more.
+func FindOpenPorts(host string, portNumStart, numPorts int) (openPorts []int) {
+	return FindOpenPortsRange(host, portNumStart, numPorts, defaultPortScan)
+}
+
+// FindOpenPortsRange is FindOpenPorts checking at most maxScan ports from
+// portNumStart. If the window is exhausted before numPorts open ports are
+// found, the ones found so far are returned.
+func FindOpenPortsRange(host string, portNumStart, numPorts, maxScan int) (openPorts []int) {
+	return findOpenPorts(context.Background(), host, portNumStart, numPorts, maxScan)
+}
+
+// FindOpenPortsContext is FindOpenPorts stopping as soon as ctx is done, in
+// which case the open ports found so far are returned
+func FindOpenPortsContext(ctx context.Context, host string, portNumStart, numPorts int) (openPorts []int) {
+	return findOpenPorts(ctx, host, portNumStart, numPorts, defaultPortScan)
+}
+
+func findOpenPorts(ctx context.Context, host string, portNumStart, numPorts, maxScan int) (openPorts []int) {
+	openPorts = []int{}
+	dialer := net.Dialer{Timeout: 100 * time.Millisecond}
+	for port := portNumStart; port-portNumStart < maxScan && port <= 65535; port++ {
+		if ctx.Err() != nil {
+			return
+		}
+		conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(host, fmt.Sprint(port)))
+		if conn != nil {
+			conn.Close()
+		} else if err != nil {
+			if ctx.Err() != nil {
+				// the dial was interrupted, the port is unknown
+				return
+			}
+			openPorts = append(openPorts, port)
+		}
+		if len(openPorts) >= numPorts {
+			return
+		}
+	}
+	return
+}
+
+// local ip determination
+// https://stackoverflow.com/questions/41240761/check-if-ip-address-is-in-private-network-space
+var privateIPBlocks []*net.IPNet
+
+func init() {
+	for _, cidr := range []string{
+		"127.0.0.0/8",    // IPv4 loopback
+		"10.0.0.0/8",     // RFC1918
+		"172.16.0.0/12",  // RFC1918
+		"192.168.0.0/16", // RFC1918
+		"169.254.0.0/16", // RFC3927 link-local
+		"::1/128",        // IPv6 loopback
+		"fe80::/10",      // IPv6 link-local
+		"fc00::/7",       // IPv6 unique local addr
+	} {
+		_, block, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(fmt.Errorf("parse error on %q: %v", cidr, err))
+		}
+		privateIPBlocks = append(privateIPBlocks, block)
+	}
+}
+
+func IsLocalIP(ipaddress string) bool {
+	if strings.Contains(ipaddress, "127.0.0.1") {
+		return true
+	}
+	host, _, err := net.SplitHostPort(ipaddress)
+	if err != nil {
+		// a bare ip without port
+		host = strings.TrimSuffix(strings.TrimPrefix(ipaddress, "["), "]")
+	}
+	ip := net.ParseIP(host)
+	if ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() {
+		return true
+	}
+	for _, block := range privateIPBlocks {
+		if block.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// IsSubpath reports whether child is parent or lexically inside it
+func IsSubpath(parent string, child string) bool {
+	relPath, err := filepath.Rel(parent, child)
+	if err != nil {
+		return false
+	}
+	return relPath != ".." && !strings.HasPrefix(relPath, ".."+string(os.PathSeparator))
+}
+
+// CanonicalizePaths resolves paths to cleaned absolute paths, removes
+// duplicates and drops any path contained in another one of the set, so that
+// passing both "/a" and "/a/b" only keeps "/a". The result is sorted.
+func CanonicalizePaths(paths []string) (canonical []string, err error) {
+	absPaths := make([]string, 0, len(paths))
+	for _, p := range paths {
+		var absPath string
+		absPath, err = filepath.Abs(p)
+		if err != nil {
+			return nil, err
+		}
+		absPaths = append(absPaths, absPath)
+	}
+	// a parent always sorts before its children
+	sort.Strings(absPaths)
+	canonical = []string{}
+	for _, absPath := range absPaths {
+		contained := false
+		for _, kept := range canonical {
+			if IsSubpath(kept, absPath) {
+				contained = true
+				break
+			}
+		}
+		if !contained {
+			canonical = append(canonical, absPath)
+		}
+	}
+	return
+}
+
+// FindBasenameCollisions returns the base names shared by more than one of
+// files, mapped to the absolute paths having them, so they can be renamed
+// before being put side by side at the root of an archive. Listing the same
+// file twice is not a collision.
+func FindBasenameCollisions(files []string) (collisions map[string][]string, err error) {
+	byName := make(map[string][]string)
+	seen := make(map[string]bool)
+	for _, fname := range files {
+		var absPath string
+		absPath, err = filepath.Abs(fname)
+		if err != nil {
+			return nil, err
+		}
+		if seen[absPath] {
+			continue
+		}
+		seen[absPath] = true
+		name := filepath.Base(absPath)
+		byName[name] = append(byName[name], absPath)
+	}
+	collisions = make(map[string][]string)
+	for name, paths := range byName {
+		if len(paths) > 1 {
+			collisions[name] = paths
+		}
+	}
+	return
+}
+
+// LinksEscaping returns the symlinks under root whose resolved targets fall
+// outside of root, so a sender can be warned before archiving them.
+func LinksEscaping(root string) (links []string, err error) {
+	resolvedRoot, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return
+	}
+	if resolvedRoot, err = filepath.Abs(resolvedRoot); err != nil {
+		return
+	}
+	links = []string{}
+	err = filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Mode()&os.ModeSymlink == 0 {
+			return nil
+		}
+		_, err = ResolveWithinRoot(resolvedRoot, path)
+		if errors.Is(err, ErrOutsideRoot) {
+			links = append(links, path)
+			return nil
+		}
+		if err == nil {
+			return nil
+		}
+		// dangling link, judge it by where it points to
+		target, err := os.Readlink(path)
+		if err != nil {
+			return err
+		}
+		if !filepath.IsAbs(target) {
+			relPath, err := filepath.Rel(root, filepath.Dir(path))
+			if err != nil {
+				return err
+			}
+			target = filepath.Join(resolvedRoot, relPath, target)
+		}
+		if target, err = filepath.Abs(target); err != nil {
+			return err
+		}
+		if !IsSubpath(resolvedRoot, target) {
+			links = append(links, path)
+		}
+		return nil
+	})
+	return
+}
+
+// ErrOutsideRoot is returned when a path resolves outside of its root
+var ErrOutsideRoot = errors.New("path is outside of root")
+
+// ResolveWithinRoot resolves the symlink linkPath and returns its absolute
+// target, or an error wrapping ErrOutsideRoot if the target is not within
+// root, so a link is only followed when it stays inside the tree
+func ResolveWithinRoot(root string, linkPath string) (target string, err error) {
+	resolvedRoot, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return
+	}
+	if resolvedRoot, err = filepath.Abs(resolvedRoot); err != nil {
+		return
+	}
+	if target, err = filepath.EvalSymlinks(linkPath); err != nil {
+		return
+	}
+	if target, err = filepath.Abs(target); err != nil {
+		return
+	}
+	if !IsSubpath(resolvedRoot, target) {
+		return "", fmt.Errorf("'%s' points to '%s': %w", linkPath, target, ErrOutsideRoot)
+	}
+	return
+}
+
+// binaryDiffMagic starts every patch made by BinaryDiff
+const binaryDiffMagic = "crocdiff1"
+
+// binaryDiffBlockSize is the size of the blocks of the old file that
+// BinaryDiff looks for in the new one
+const binaryDiffBlockSize = 2048
+
+// binaryDiffOp is an operation of a patch: either copying length bytes at
+// offset in the old file, or inserting literal bytes
+type binaryDiffOp struct {
+	offset  int64
+	length  int64
+	literal []byte
+}
+
+// blockSignature is the strong checksum of a block of the old file
+type blockSignature struct {
+	offset int64
+	strong uint64
+}
+
+// weakChecksum returns the two halves of the rsync rolling checksum of block
+func weakChecksum(block []byte) (a uint32, b uint32) {
+	n := len(block)
+	for i, c := range block {
+		a += uint32(c)
+		b += uint32(n-i) * uint32(c)
+	}
+	return a & 0xffff, b & 0xffff
+}
+
+// BinaryDiff returns a patch turning oldFname into newFname with
+// ApplyBinaryDiff. Like rsync, the blocks of the old file are located in
+// the new one with a rolling checksum and referenced by the patch, which
+// only carries the bytes that are new. The new file is read into memory.
+func BinaryDiff(oldFname string, newFname string) (patch []byte, err error) {
+	signatures := make(map[uint32][]blockSignature)
+	err = ProcessFileChunks(oldFname, binaryDiffBlockSize, func(offset int64, chunk []byte) error {
+		if len(chunk) == binaryDiffBlockSize {
+			a, b := weakChecksum(chunk)
+			signatures[b<<16|a] = append(signatures[b<<16|a], blockSignature{offset: offset, strong: xxhash.Sum64(chunk)})
+		}
+		return nil
+	})
+	if err != nil {
+		return
+	}
+	newData, err := os.ReadFile(newFname)
+	if err != nil {
+		return
+	}
+
+	var ops []binaryDiffOp
+	addCopy := func(offset int64) {
+		if last := len(ops) - 1; last >= 0 && ops[last].literal == nil && ops[last].offset+ops[last].length == offset {
+			ops[last].length += binaryDiffBlockSize
+			return
+		}
+		ops = append(ops, binaryDiffOp{offset: offset, length: binaryDiffBlockSize})
+	}
+	literalStart := 0
+	var a, b uint32
+	rolled := false
+	for i := 0; i+binaryDiffBlockSize <= len(newData); {
+		block := newData[i : i+binaryDiffBlockSize]
+		if !rolled {
+			a, b = weakChecksum(block)
+			rolled = true
+		}
+		if candidates, ok := signatures[b<<16|a]; ok {
+			strong := xxhash.Sum64(block)
+			for _, candidate := range candidates {
+				if candidate.strong == strong {
+					if literalStart < i {
+						ops = append(ops, binaryDiffOp{literal: newData[literalStart:i]})
+					}
+					addCopy(candidate.offset)
+					i += binaryDiffBlockSize
+					literalStart = i
+					rolled = false
+					break
+				}
+			}
+			if !rolled {
+				continue
+			}
+		}
+		if i+binaryDiffBlockSize < len(newData) {
+			out, in := uint32(newData[i]), uint32(newData[i+binaryDiffBlockSize])
+			a = (a - out + in) & 0xffff
+			b = (b - binaryDiffBlockSize*out + a) & 0xffff
+		}
+		i++
+	}
+	if literalStart < len(newData) {
+		ops = append(ops, binaryDiffOp{literal: newData[literalStart:]})
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString(binaryDiffMagic)
+	buf.Write(binary.AppendUvarint(nil, uint64(len(newData))))
+	buf.Write(binary.BigEndian.AppendUint64(nil, xxhash.Sum64(newData)))
+	for _, op := range ops {
+		if op.literal != nil {
+			buf.WriteByte('l')
+			buf.Write(binary.AppendUvarint(nil, uint64(len(op.literal))))
+			buf.Write(op.literal)
+		} else {
+			buf.WriteByte('c')
+			buf.Write(binary.AppendUvarint(nil, uint64(op.offset)))
+			buf.Write(binary.AppendUvarint(nil, uint64(op.length)))
+		}
+	}
+	patch = buf.Bytes()
+	return
+}
+
+// errPatchTooLong is returned when a patch writes more than the size it
+// declares, which is checked before writing so it can't fill the disk
+var errPatchTooLong = errors.New("invalid patch: longer than the size it declares")
+
+// ApplyBinaryDiff writes to outFname the file that the patch made by
+// BinaryDiff describes, using the blocks of oldFname. The result is checked
+// against the size and hash recorded in the patch and written atomically.
+func ApplyBinaryDiff(oldFname string, patch []byte, outFname string) (err error) {
+	if !bytes.HasPrefix(patch, []byte(binaryDiffMagic)) {
+		return fmt.Errorf("invalid patch")
+	}
+	r := bytes.NewReader(patch[len(binaryDiffMagic):])
+	size, err := binary.ReadUvarint(r)
+	if err != nil {
+		return fmt.Errorf("invalid patch: %w", err)
+	}
+	var expected uint64
+	if err = binary.Read(r, binary.BigEndian, &expected); err != nil {
+		return fmt.Errorf("invalid patch: %w", err)
+	}
+	old, err := os.Open(oldFname)
+	if err != nil {
+		return
+	}
+	defer old.Close()
+
+	return writeAtomic(outFname, 0o644, func(w io.Writer) (err error) {
+		h := xxhash.New()
+		out := io.MultiWriter(w, h)
+		var written uint64
+		for r.Len() > 0 {
+			op, _ := r.ReadByte()
+			var offset, length uint64
+			switch op {
+			case 'c':
+				if offset, err = binary.ReadUvarint(r); err != nil {
+					return fmt.Errorf("invalid patch: %w", err)
+				}
+				if length, err = binary.ReadUvarint(r); err != nil {
+					return fmt.Errorf("invalid patch: %w", err)
+				}
+				if offset > math.MaxInt64 || length > math.MaxInt64 {
+					return fmt.Errorf("invalid patch: copy out of range")
+				}
+				if length > size-written {
+					return errPatchTooLong
+				}
+				var n int64
+				n, err = io.Copy(out, io.NewSectionReader(old, int64(offset), int64(length)))
+				if err != nil {
+					return
+				}
+				if uint64(n) != length {
+					return fmt.Errorf("'%s' is shorter than the patch expects", oldFname)
+				}
+			case 'l':
+				if length, err = binary.ReadUvarint(r); err != nil {
+					return fmt.Errorf("invalid patch: %w", err)
+				}
+				if length > uint64(r.Len()) {
+					return fmt.Errorf("invalid patch: truncated literal")
+				}
+				if length > size-written {
+					return errPatchTooLong
+				}
+				if _, err = io.CopyN(out, r, int64(length)); err != nil {
+					return
+				}
+			default:
+				return fmt.Errorf("invalid patch: unknown operation %q", op)
+			}
+			written += length
+		}
+		if written != size || h.Sum64() != expected {
+			return fmt.Errorf("patched file doesn't match, was '%s' modified?", oldFname)
+		}
+		return nil
+	})
+}
+
+// EstimateCompressibility compresses up to sampleBytes from the start of a
+// file with flate and returns the compressed/original size ratio. A ratio
+// near 1 means compression isn't worthwhile (e.g. already-compressed media).
+func EstimateCompressibility(fname string, sampleBytes int64) (ratio float64, err error) {
+	f, err := os.Open(fname)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	var compressed bytes.Buffer
+	w, err := flate.NewWriter(&compressed, flate.DefaultCompression)
+	if err != nil {
+		return
+	}
+	n, err := io.Copy(w, io.LimitReader(f, sampleBytes))
+	if err != nil {
+		return
+	}
+	if err = w.Close(); err != nil {
+		return
+	}
+	if n == 0 {
+		return 1, nil
+	}
+	ratio = float64(compressed.Len()) / float64(n)
+	return
+}
+
+// crocArchiveComment is the comment of the zip archives written by croc,
+// which IsCrocArchive looks for
+const crocArchiveComment = "croc archive"
+
+// IsCrocArchive reports whether the zip archive source was written by one
+// of the ZipDirectory functions of croc, from the comment they set, without
+// extracting it
+func IsCrocArchive(source string) (isCroc bool, err error) {
+	archive, err := zip.OpenReader(source)
+	if err != nil {
+		return
+	}
+	defer archive.Close()
+	isCroc = archive.Comment == crocArchiveComment
+	return
+}
+
+// ZipOptions changes how ZipDirectoryOpts archives a directory
+type ZipOptions struct {
+	// StoreSymlinks records symlinks as entries holding their target, the
+	// way Info-ZIP does, instead of the content of the file they point to.
+	// This isn't part of the zip format so other tools may extract them as
+	// small text files, and creating them again on Windows needs Developer
+	// Mode or administrator rights.
+	StoreSymlinks bool
+}
+
+// ZipDirectory zips the regular files under source to destination,
+// storing the content of the files symlinks point to when they are inside
+// source and skipping the other links
+func ZipDirectory(destination string, source string) (err error) {
+	return ZipDirectoryOpts(destination, source, ZipOptions{})
+}
+
+// ZipDirectoryOpts zips the regular files and symlinks under source to
+// destination as set by opts. Symlinks to directories are only kept with
+// StoreSymlinks, as they are not followed.
+func ZipDirectoryOpts(destination string, source string, opts ZipOptions) (err error) {
+	if _, err = os.Stat(destination); err == nil {
+		log.Errorf("%s file already exists!\n", destination)
+	}
+	fmt.Fprintf(os.Stderr, "Zipping %s to %s\n", source, destination)
+	file, err := os.Create(destination)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+	writer := zip.NewWriter(file)
+	writer.SetComment(crocArchiveComment)
+	// no compression because croc does its compression on the fly
+	writer.RegisterCompressor(zip.Deflate, func(out io.Writer) (io.WriteCloser, error) {
+		return flate.NewWriter(out, flate.NoCompression)
+	})
+	err = filepath.Walk(source, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		var link string
+		if info.Mode()&os.ModeSymlink != 0 {
+			if opts.StoreSymlinks {
+				if link, err = os.Readlink(path); err != nil {
+					return err
+				}
+			} else {
+				// only follow links that stay inside source, so that a link
+				// to e.g. ~/.ssh/id_rsa doesn't get sent
+				var target string
+				if target, err = ResolveWithinRoot(source, path); err != nil {
+					if errors.Is(err, ErrOutsideRoot) || errors.Is(err, os.ErrNotExist) {
+						log.Warnf("skipping link %s: %s", path, err)
+						return nil
+					}
+					return err
+				}
+				if info, err = os.Stat(target); err != nil {
+					return err
+				}
+			}
+		}
+		if link == "" && !info.Mode().IsRegular() {
+			return nil
+		}
+		zipPath := strings.ReplaceAll(path, source, strings.TrimSuffix(destination, ".zip"))
+		zipPath = filepath.ToSlash(zipPath)
+		// keep the mode bits and mtime of the file
+		header, err := zip.FileInfoHeader(info)
+		if err != nil {
+			return err
+		}
+		header.Name = zipPath
+		header.Method = zip.Deflate
+		w1, err := writer.CreateHeader(header)
+		if err != nil {
+			return err
+		}
+		if link != "" {
+			_, err = io.WriteString(w1, filepath.ToSlash(link))
+		} else {
+			_, err = copyFileTo(w1, path)
+		}
+		if err != nil {
+			return fmt.Errorf("could not add '%s': %w", path, err)
+		}
+		fmt.Fprintf(os.Stderr, "\r\033[2K")
+		fmt.Fprintf(os.Stderr, "\rAdding %s", zipPath)
+		return nil
+	})
+	fmt.Fprintf(os.Stderr, "\n")
+	if err != nil {
+		return
+	}
+	if err = writer.Close(); err != nil {
+		return
+	}
+	return file.Close()
+}
+
+// SmallFileEntry locates a file inside a stream written by PackSmallFiles
+type SmallFileEntry struct {
+	Name   string
+	Offset int64
+	Length int64
+}
+
+// PackSmallFiles concatenates files into w and returns an index to split
+// them back out with UnpackSmallFiles. When sending thousands of tiny files
+// this avoids the per-entry overhead of a zip archive. Files are stored by
+// base name, so the base names must be unique.
+func PackSmallFiles(files []string, w io.Writer) (index []SmallFileEntry, err error) {
+	index = make([]SmallFileEntry, 0, len(files))
+	names := make(map[string]bool)
+	var offset int64
+	for _, fname := range files {
+		name := filepath.Base(fname)
+		if names[name] {
+			return nil, fmt.Errorf("duplicate file name '%s'", name)
+		}
+		names[name] = true
+		var n int64
+		n, err = copyFileTo(w, fname)
+		if err != nil {
+			return nil, err
+		}
+		index = append(index, SmallFileEntry{Name: name, Offset: offset, Length: n})
+		offset += n
+	}
+	return
+}
+
+// copyFileTo copies the content of fname to w
+func copyFileTo(w io.Writer, fname string) (n int64, err error) {
+	f, err := os.Open(fname)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	return io.Copy(w, f)
+}
+
+// CopyPair is a file to copy from Src to Dst
+type CopyPair struct {
+	Src string
+	Dst string
+}
+
+// CopyFilesWithProgress copies each pair, creating the directories of Dst
+// as needed, and calls cb with the bytes copied so far across all the files
+// and the total size of the files, which is computed first. It stops at the
+// first file that can't be copied.
+func CopyFilesWithProgress(pairs []CopyPair, cb func(done, total int64)) (err error) {
+	progress := &callbackReporter{cb: cb}
+	modes := make([]os.FileMode, len(pairs))
+	for i, pair := range pairs {
+		var fstat os.FileInfo
+		if fstat, err = os.Stat(pair.Src); err != nil {
+			return fmt.Errorf("could not copy '%s': %w", pair.Src, err)
+		}
+		progress.total += fstat.Size()
+		modes[i] = fstat.Mode().Perm()
+	}
+	for i, pair := range pairs {
+		if err = copyFileWithProgress(pair, modes[i], progress); err != nil {
+			return fmt.Errorf("could not copy '%s': %w", pair.Src, err)
+		}
+	}
+	return
+}
+
+func copyFileWithProgress(pair CopyPair, perm os.FileMode, progress ProgressReporter) (err error) {
+	if err = os.MkdirAll(filepath.Dir(pair.Dst), os.ModePerm); err != nil {
+		return
+	}
+	dst, err := os.OpenFile(pair.Dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return
+	}
+	_, err = copyFileTo(io.MultiWriter(dst, progressWriter{progress}), pair.Src)
+	if errClose := dst.Close(); err == nil {
+		err = errClose
+	}
+	return
+}
+
+// UnpackSmallFiles writes the files of a PackSmallFiles stream into destDir
+func UnpackSmallFiles(r io.ReaderAt, index []SmallFileEntry, destDir string) (err error) {
+	if err = os.MkdirAll(destDir, os.ModePerm); err != nil {
+		return
+	}
+	for _, entry := range index {
+		if err = ValidFileName(entry.Name); err != nil {
+			return
+		}
+		if entry.Name != filepath.Base(entry.Name) || entry.Name == "." {
+			return fmt.Errorf("invalid file name '%s'", entry.Name)
+		}
+		if entry.Offset < 0 || entry.Length < 0 {
+			return fmt.Errorf("invalid range for '%s'", entry.Name)
+		}
+		if err = writeSmallFile(filepath.Join(destDir, entry.Name), io.NewSectionReader(r, entry.Offset, entry.Length), entry.Length); err != nil {
+			return
+		}
+	}
+	return
+}
+
+func writeSmallFile(fname string, r io.Reader, length int64) (err error) {
+	f, err := os.Create(fname)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	n, err := io.Copy(f, r)
+	if err == nil && n != length {
+		err = fmt.Errorf("short read for '%s': %d of %d bytes", fname, n, length)
+	}
+	return
+}
+
+// reproducibleModTime is the timestamp given to every entry of a
+// reproducible archive (the start of the zip DOS epoch)
+var reproducibleModTime = time.Date(1980, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// ZipDirectoryReproducible zips source like ZipDirectory, but normalizes
+// timestamps, sorts entries and fixes the compression settings so that the
+// same tree always yields byte-identical archives.
+func ZipDirectoryReproducible(destination string, source string) (err error) {
+	var fnames []string
+	infos := make(map[string]os.FileInfo)
+	err = filepath.Walk(source, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() {
+			fnames = append(fnames, path)
+			infos[path] = info
+		}
+		return nil
+	})
+	if err != nil {
+		return
+	}
+	sort.Strings(fnames)
+
+	fmt.Fprintf(os.Stderr, "Zipping %s to %s\n", source, destination)
+	file, err := os.Create(destination)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+	writer := zip.NewWriter(file)
+	writer.SetComment(crocArchiveComment)
+	writer.RegisterCompressor(zip.Deflate, func(out io.Writer) (io.WriteCloser, error) {
+		return flate.NewWriter(out, flate.NoCompression)
+	})
+	for _, fname := range fnames {
+		zipPath := strings.ReplaceAll(fname, source, strings.TrimSuffix(destination, ".zip"))
+		zipPath = filepath.ToSlash(zipPath)
+		header := &zip.FileHeader{
+			Name:     zipPath,
+			Method:   zip.Deflate,
+			Modified: reproducibleModTime,
+		}
+		header.SetMode(infos[fname].Mode().Perm())
+		if err = addFileToZip(writer, header, fname); err != nil {
+			return
+		}
+		fmt.Fprintf(os.Stderr, "\r\033[2K")
+		fmt.Fprintf(os.Stderr, "\rAdding %s", zipPath)
+	}
+	fmt.Fprintf(os.Stderr, "\n")
+	return writer.Close()
+}
+
+// addFileToZip copies the content of fname into a new entry of writer
+func addFileToZip(writer *zip.Writer, header *zip.FileHeader, fname string) (err error) {
+	f, err := os.Open(fname)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	w, err := writer.CreateHeader(header)
+	if err != nil {
+		return
+	}
+	_, err = io.Copy(w, f)
+	return
+}
+
+// zipIndexEntry records an entry fully written to a partial archive by
+// ZipDirectoryResumable, along with the state of its source file
+type zipIndexEntry struct {
+	Name    string      `json:"name"`
+	Offset  int64       `json:"offset"`
+	Size    int64       `json:"size"`
+	CRC32   uint32      `json:"crc32"`
+	Mode    os.FileMode `json:"mode"`
+	ModTime time.Time   `json:"mod_time"`
+}
+
+// onZipEntryAdded is called after ZipDirectoryResumable reads a file into
+// the archive, replaced in tests to interrupt it
+var onZipEntryAdded = func(name string) error { return nil }
+
+// ZipDirectoryResumable zips source like ZipDirectory, but can pick up
+// where an interrupted run left off instead of reading every file again.
+//
+// A zip archive is only readable once its central directory is written at
+// the very end, so a partial archive can't simply be appended to. Instead
+// the archive is built at destination+".partial.new", entries are stored
+// uncompressed, and a sidecar index records the offset, size and CRC32 of
+// each entry once it is written, along with the size and mtime of its
+// source file. A re-run rebuilds the archive, but copies the stored bytes
+// of the files that are unchanged from the previous partial archive rather
+// than reading them from source again. The partial files are removed when
+// the archive is complete.
+func ZipDirectoryResumable(destination string, source string) (err error) {
+	partial := destination + ".partial"
+	next := partial + ".new"
+	if err = promoteZipPartial(partial, next); err != nil {
+		return
+	}
+	previous := make(map[string]zipIndexEntry)
+	var previousArchive *os.File
+	if entries, errIndex := readZipIndex(partial + ".index"); errIndex == nil {
+		if previousArchive, err = os.Open(partial); err == nil {
+			defer previousArchive.Close()
+			for _, entry := range entries {
+				previous[entry.Name] = entry
+			}
+		} else if !os.IsNotExist(err) {
+			return
+		}
+	}
+
+	fmt.Fprintf(os.Stderr, "Zipping %s to %s\n", source, destination)
+	file, err := os.Create(next)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+	index, err := os.Create(next + ".index")
+	if err != nil {
+		return
+	}
+	defer index.Close()
+	writer := zip.NewWriter(file)
+	writer.SetComment(crocArchiveComment)
+	err = filepath.Walk(source, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		zipPath := strings.ReplaceAll(path, source, strings.TrimSuffix(destination, ".zip"))
+		zipPath = filepath.ToSlash(zipPath)
+		var entry zipIndexEntry
+		if prev, ok := previous[zipPath]; ok && prev.Size == info.Size() && prev.ModTime.Equal(info.ModTime()) && prev.Mode == info.Mode().Perm() {
+			entry, err = copyZipEntry(writer, file, previousArchive, prev)
+		} else {
+			entry, err = addZipEntry(writer, file, path, zipPath, info)
+			if err == nil {
+				err = onZipEntryAdded(zipPath)
+			}
+		}
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "\r\033[2K")
+		fmt.Fprintf(os.Stderr, "\rAdding %s", zipPath)
+		b, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		_, err = index.Write(append(b, '\n'))
+		return err
+	})
+	fmt.Fprintf(os.Stderr, "\n")
+	if err != nil {
+		return
+	}
+	if err = writer.Close(); err != nil {
+		return
+	}
+	if err = file.Close(); err != nil {
+		return
+	}
+	if err = os.Rename(next, destination); err != nil {
+		return
+	}
+	for _, fname := range []string{next + ".index", partial, partial + ".index"} {
+		if errRemove := os.Remove(fname); errRemove != nil && !os.IsNotExist(errRemove) {
+			log.Warnf("could not remove %s: %s", fname, errRemove)
+		}
+	}
+	return
+}
+
+// promoteZipPartial keeps whichever of the partial archives at partial and
+// next (left over from an interrupted resume) has the most entries as
+// partial, and removes the other one
+func promoteZipPartial(partial string, next string) (err error) {
+	nextEntries, errNext := readZipIndex(next + ".index")
+	if errNext != nil || !Exists(next) {
+		return nil
+	}
+	entries, _ := readZipIndex(partial + ".index")
+	if len(nextEntries) < len(entries) {
+		os.Remove(next)
+		os.Remove(next + ".index")
+		return nil
+	}
+	if err = os.Rename(next, partial); err != nil {
+		return
+	}
+	return os.Rename(next+".index", partial+".index")
+}
+
+// readZipIndex reads the entries of a sidecar index, ignoring a last line
+// cut short by an interruption
+func readZipIndex(fname string) (entries []zipIndexEntry, err error) {
+	b, err := os.ReadFile(fname)
+	if err != nil {
+		return
+	}
+	for _, line := range strings.Split(string(b), "\n") {
+		var entry zipIndexEntry
+		if json.Unmarshal([]byte(line), &entry) != nil {
+			break
+		}
+		entries = append(entries, entry)
+	}
+	return
+}
+
+// addZipEntry stores the file at path in writer as zipPath and returns
+// where its data was written in file
+func addZipEntry(writer *zip.Writer, file *os.File, path string, zipPath string, info os.FileInfo) (entry zipIndexEntry, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	header := &zip.FileHeader{
+		Name:     zipPath,
+		Method:   zip.Store,
+		Modified: info.ModTime(),
+	}
+	header.SetMode(info.Mode().Perm())
+	w, err := writer.CreateHeader(header)
+	if err != nil {
+		return
+	}
+	if entry.Offset, err = flushedOffset(writer, file); err != nil {
+		return
+	}
+	h := crc32.NewIEEE()
+	if entry.Size, err = io.Copy(io.MultiWriter(w, h), f); err != nil {
+		return
+	}
+	if _, err = flushedOffset(writer, file); err != nil {
+		return
+	}
+	entry.Name = zipPath
+	entry.CRC32 = h.Sum32()
+	entry.Mode = info.Mode().Perm()
+	entry.ModTime = info.ModTime()
+	return
+}
+
+// copyZipEntry stores prev, read from the previous partial archive, in
+// writer without reading its source file again
+func copyZipEntry(writer *zip.Writer, file *os.File, previousArchive *os.File, prev zipIndexEntry) (entry zipIndexEntry, err error) {
+	header := &zip.FileHeader{
+		Name:               prev.Name,
+		Method:             zip.Store,
+		Modified:           prev.ModTime,
+		CRC32:              prev.CRC32,
+		CompressedSize64:   uint64(prev.Size),
+		UncompressedSize64: uint64(prev.Size),
+	}
+	header.SetMode(prev.Mode)
+	w, err := writer.CreateRaw(header)
+	if err != nil {
+		return
+	}
+	entry = prev
+	if entry.Offset, err = flushedOffset(writer, file); err != nil {
+		return
+	}
+	n, err := io.Copy(w, io.NewSectionReader(previousArchive, prev.Offset, prev.Size))
+	if err != nil {
+		return
+	}
+	if n != prev.Size {
+		err = fmt.Errorf("partial archive is missing data for '%s'", prev.Name)
+		return
+	}
+	_, err = flushedOffset(writer, file)
+	return
+}
+
+// flushedOffset flushes writer to file and returns the offset it reached
+func flushedOffset(writer *zip.Writer, file *os.File) (offset int64, err error) {
+	if err = writer.Flush(); err != nil {
+		return
+	}
+	return file.Seek(0, io.SeekCurrent)
+}
+
+// UnzipDirectory extracts the zip archive source into destination, asking
+// before overwriting existing files. Entries with unsafe names, symlinks
+// and entries that would be written through a symlink pointing outside of
+// destination are skipped, any other failure stops the extraction and is
+// returned.
+func UnzipDirectory(destination string, source string) (err error) {
+	return UnzipDirectoryOpts(destination, source, UnzipOptions{})
+}
+
+// UnzipDirectoryWithPolicy is UnzipDirectory handling existing files as
+// set by policy, so that it can run without a terminal
+func UnzipDirectoryWithPolicy(destination string, source string, policy OverwritePolicy) (err error) {
+	return UnzipDirectoryOpts(destination, source, UnzipOptions{Overwrite: policy})
+}
+
+// UnzipOptions changes how UnzipDirectoryOpts extracts an archive
+type UnzipOptions struct {
+	// Overwrite is what to do with files that already exist
+	Overwrite OverwritePolicy
+	// RestoreSymlinks recreates the symlinks stored with
+	// ZipOptions.StoreSymlinks when they point inside the destination.
+	// They are skipped otherwise, which is safer for archives from an
+	// untrusted peer.
+	RestoreSymlinks bool
+}
+
+// UnzipDirectoryOpts is UnzipDirectory extracting as set by opts
+func UnzipDirectoryOpts(destination string, source string, opts UnzipOptions) (err error) {
+	if opts.Overwrite < OverwritePrompt || opts.Overwrite > OverwriteFail {
+		return fmt.Errorf("unknown overwrite policy %d", opts.Overwrite)
+	}
+	archive, err := zip.OpenReader(source)
+	if err != nil {
+		return
+	}
+	defer archive.Close()
+
+	destRoot := filepath.Clean(destination)
+	overwrite := overwritePrompter{policy: opts.Overwrite}
+	for _, f := range archive.File {
+		name, mode, errName := SanitizeZipEntry(f.Name, f.Mode())
+		if errName != nil {
+			log.Error(errName)
+			continue
+		}
+		if mode&os.ModeSymlink != 0 && !opts.RestoreSymlinks {
+			log.Debugf("skipping symlink %s", f.Name)
+			continue
+		}
+		filePath := filepath.Join(destRoot, filepath.FromSlash(name))
+		fmt.Fprintf(os.Stderr, "\r\033[2K")
+		fmt.Fprintf(os.Stderr, "\rUnzipping file %s", filePath)
+		// Issue #593 conceal path traversal vulnerability
+		// make sure the file stays inside the destination, links included
+		if !IsSubpath(destRoot, filePath) {
+			log.Errorf("Invalid file path %s\n", filePath)
+			continue
+		}
+		if err = checkInsideRoot(destRoot, filepath.Dir(filePath)); err != nil {
+			if !errors.Is(err, ErrOutsideRoot) {
+				return
+			}
+			log.Error(err)
+			err = nil
+			continue
+		}
+		if f.FileInfo().IsDir() {
+			if err = os.MkdirAll(filePath, os.ModePerm); err != nil {
+				return
+			}
+			continue
+		}
+
+		if err = os.MkdirAll(filepath.Dir(filePath), os.ModePerm); err != nil {
+			return
+		}
+
+		// check if file exists
+		if _, errStat := os.Stat(filePath); errStat == nil {
+			var allowed bool
+			if allowed, err = overwrite.allow(filePath); err != nil {
+				return
+			}
+			if !allowed {
+				fmt.Fprintf(os.Stderr, "Skipping '%s'\n", filePath)
+				continue
+			}
+		}
+
+		if mode&os.ModeSymlink != 0 {
+			err = writeZipSymlink(destRoot, filePath, f)
+			if errors.Is(err, ErrOutsideRoot) {
+				log.Error(err)
+				err = nil
+			}
+		} else {
+			err = unzipFile(f, filePath, mode)
+		}
+		if err != nil {
+			return
+		}
+	}
+	fmt.Fprintf(os.Stderr, "\n")
+	return
+}
+
+// unzipFile writes the zip entry f to filePath with mode and its mtime
+func unzipFile(f *zip.File, filePath string, mode os.FileMode) (err error) {
+	dstFile, err := createExtractedFile(filePath, mode)
+	if err != nil {
+		return
+	}
+	fileInArchive, err := f.Open()
+	if err != nil {
+		dstFile.Close()
+		return
+	}
+	_, err = io.Copy(dstFile, fileInArchive)
+	fileInArchive.Close()
+	if errClose := dstFile.Close(); err == nil {
+		err = errClose
+	}
+	if err != nil {
+		return fmt.Errorf("could not extract '%s': %w", f.Name, err)
+	}
+	if !f.Modified.IsZero() {
+		err = os.Chtimes(filePath, f.Modified, f.Modified)
+	}
+	return
+}
+
+// ErrHashMismatch is returned when a file doesn't have the expected hash
+var ErrHashMismatch = errors.New("hash mismatch")
+
+// VerifyAndUnzip hashes the archive source with algorithm and extracts it
+// into destination with UnzipDirectory only if the hash is expected,
+// returning ErrHashMismatch without writing anything otherwise. Only
+// algorithms hashing the whole content are accepted: imohash samples the
+// file and md5 and sha1 are broken, so a tampered archive could pass them.
+func VerifyAndUnzip(destination string, source string, algorithm string, expected []byte) (err error) {
+	switch algorithm {
+	case "sha512", "xxhash", "highway":
+	default:
+		return fmt.Errorf("%s can't be used to verify an archive", algorithm)
+	}
+	hash, err := HashFile(source, algorithm)
+	if err != nil {
+		return
+	}
+	if !HashEqual(hash, expected) {
+		return ErrHashMismatch
+	}
+	return UnzipDirectory(destination, source)
+}
+
+// ShouldSkipReceive reports whether fname already exists with the
+// expectedHash, in which case receiving it again can be skipped
+func ShouldSkipReceive(fname string, expectedHash []byte, algorithm string) (skip bool, err error) {
+	fstats, err := os.Lstat(fname)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil || fstats.IsDir() {
+		return
+	}
+	hash, err := HashFile(fname, algorithm)
+	if err != nil {
+		return
+	}
+	skip = HashEqual(hash, expectedHash)
+	return
+}
+
+// UnzipDirectoryVerified extracts source into destination like
+// UnzipDirectory, skipping symlinks, but stops at the first error and
+// checks the CRC32 of
+// each extracted entry against the one stored in the archive, returning
+// an error naming any entry that doesn't match.
+func UnzipDirectoryVerified(destination string, source string) (err error) {
+	archive, err := zip.OpenReader(source)
+	if err != nil {
+		return
+	}
+	defer archive.Close()
+
+	destRoot := filepath.Clean(destination)
+	var overwrite overwritePrompter
+	for _, f := range archive.File {
+		name, mode, errName := SanitizeZipEntry(f.Name, f.Mode())
+		if errName != nil {
+			return errName
+		}
+		filePath := filepath.Join(destRoot, filepath.FromSlash(name))
+		fmt.Fprintf(os.Stderr, "\r\033[2K")
+		fmt.Fprintf(os.Stderr, "\rUnzipping file %s", filePath)
+		if !IsSubpath(destRoot, filePath) {
+			return fmt.Errorf("invalid file path %s", filePath)
+		}
+		if mode&os.ModeSymlink != 0 {
+			log.Debugf("skipping symlink %s", f.Name)
+			continue
+		}
+		if err = checkInsideRoot(destRoot, filepath.Dir(filePath)); err != nil {
+			return
+		}
+		if f.FileInfo().IsDir() {
+			if err = os.MkdirAll(filePath, os.ModePerm); err != nil {
+				return
+			}
+			continue
+		}
+		if err = os.MkdirAll(filepath.Dir(filePath), os.ModePerm); err != nil {
+			return
+		}
+
+		// check if file exists
+		if _, errStat := os.Stat(filePath); errStat == nil {
+			if !overwrite.confirm(filePath) {
+				fmt.Fprintf(os.Stderr, "Skipping '%s'\n", filePath)
+				continue
+			}
+		}
+
+		if err = unzipFileVerified(f, filePath, mode); err != nil {
+			return
+		}
+	}
+	fmt.Fprintf(os.Stderr, "\n")
+	return
+}
+
+// writeZipSymlink recreates the symlink entry f, whose content is the link
+// target, at filePath
+func writeZipSymlink(destRoot string, filePath string, f *zip.File) (err error) {
+	r, err := f.Open()
+	if err != nil {
+		return
+	}
+	target, err := io.ReadAll(io.LimitReader(r, 4096))
+	if errClose := r.Close(); err == nil {
+		err = errClose
+	}
+	if err != nil {
+		return
+	}
+	return writeSymlink(destRoot, filePath, string(target), f.Name)
+}
+
+// unzipFileVerified writes the zip entry f to filePath with mode, reading it to the
+// end so the zip reader validates it, and compares its CRC32 to the header
+func unzipFileVerified(f *zip.File, filePath string, mode os.FileMode) (err error) {
+	dstFile, err := createExtractedFile(filePath, mode)
+	if err != nil {
+		return
+	}
+	defer dstFile.Close()
+	fileInArchive, err := f.Open()
+	if err != nil {
+		return
+	}
+	h := crc32.NewIEEE()
+	_, err = io.Copy(io.MultiWriter(dstFile, h), fileInArchive)
+	if errClose := fileInArchive.Close(); err == nil {
+		err = errClose
+	}
+	if err != nil {
+		return fmt.Errorf("could not extract '%s': %w", f.Name, err)
+	}
+	if h.Sum32() != f.CRC32 {
+		return fmt.Errorf("crc32 mismatch for '%s': %08x != %08x", f.Name, h.Sum32(), f.CRC32)
+	}
+	return
+}
+
+// TarDirectory writes the regular files and symlinks under source to an
+// uncompressed tar archive at destination, keeping their mode bits, mtimes
+// and link targets
+func TarDirectory(destination string, source string) (err error) {
+	return tarDirectory(destination, source, false)
+}
+
+// TarGzDirectory writes the regular files and symlinks under source to a
+// gzipped tar archive at destination, keeping their mode bits, mtimes and
+// link targets
+func TarGzDirectory(destination string, source string) (err error) {
+	return tarDirectory(destination, source, true)
+}
+
+func tarDirectory(destination string, source string, gzipped bool) (err error) {
+	if _, err = os.Stat(destination); err == nil {
+		log.Errorf("%s file already exists!\n", destination)
+	}
+	fmt.Fprintf(os.Stderr, "Archiving %s to %s\n", source, destination)
+	file, err := os.Create(destination)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+	var w io.Writer = file
+	if gzipped {
+		gw := gzip.NewWriter(file)
+		defer func() {
+			if errClose := gw.Close(); err == nil {
+				err = errClose
+			}
+		}()
+		w = gw
+	}
+	writer := tar.NewWriter(w)
+	defer func() {
+		if errClose := writer.Close(); err == nil {
+			err = errClose
+		}
+	}()
+	prefix := strings.TrimSuffix(destination, archiveExtension(destination))
+	err = filepath.Walk(source, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		var link string
+		switch {
+		case info.Mode().IsRegular():
+		case info.Mode()&os.ModeSymlink != 0:
+			if link, err = os.Readlink(path); err != nil {
+				return err
+			}
+		default:
+			return nil
+		}
+		tarPath := strings.ReplaceAll(path, source, prefix)
+		tarPath = filepath.ToSlash(tarPath)
+		header, err := tar.FileInfoHeader(info, filepath.ToSlash(link))
+		if err != nil {
+			return err
+		}
+		header.Name = tarPath
+		if err = writer.WriteHeader(header); err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "\r\033[2K")
+		fmt.Fprintf(os.Stderr, "\rAdding %s", tarPath)
+		if header.Typeflag == tar.TypeSymlink {
+			return nil
+		}
+		f1, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f1.Close()
+		_, err = io.Copy(writer, f1)
+		return err
+	})
+	fmt.Fprintf(os.Stderr, "\n")
+	return
+}
+
+// UntarDirectory extracts an uncompressed tar archive into destination
+func UntarDirectory(destination string, source string) (err error) {
+	return untarDirectory(destination, source, false)
+}
+
+// UntarGzDirectory extracts a gzipped tar archive into destination
+func UntarGzDirectory(destination string, source string) (err error) {
+	return untarDirectory(destination, source, true)
+}
+
+func untarDirectory(destination string, source string, gzipped bool) (err error) {
+	file, err := os.Open(source)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+	var r io.Reader = file
+	if gzipped {
+		var gr *gzip.Reader
+		gr, err = gzip.NewReader(file)
+		if err != nil {
+			return
+		}
+		defer gr.Close()
+		r = gr
+	}
+	reader := tar.NewReader(r)
+	destRoot := filepath.Clean(destination)
+	var overwrite overwritePrompter
+	for {
+		var header *tar.Header
+		header, err = reader.Next()
+		if err == io.EOF {
+			err = nil
+			break
+		}
+		if err != nil {
+			return
+		}
+		filePath := filepath.Join(destRoot, header.Name)
+		fmt.Fprintf(os.Stderr, "\r\033[2K")
+		fmt.Fprintf(os.Stderr, "\rExtracting file %s", filePath)
+		if !IsSubpath(destRoot, filePath) {
+			err = fmt.Errorf("invalid file path %s", filePath)
+			return
+		}
+		// entries can't be written through the links extracted before them
+		if err = checkInsideRoot(destRoot, filepath.Dir(filePath)); err != nil {
+			return
+		}
+		if header.Typeflag == tar.TypeDir {
+			if err = os.MkdirAll(filePath, os.ModePerm); err != nil {
+				return
+			}
+			continue
+		}
+		if header.Typeflag != tar.TypeReg && header.Typeflag != tar.TypeSymlink {
+			log.Debugf("skipping %s with unsupported type %c", header.Name, header.Typeflag)
+			continue
+		}
+		if err = os.MkdirAll(filepath.Dir(filePath), os.ModePerm); err != nil {
+			return
+		}
+
+		// check if file exists
+		if _, errStat := os.Lstat(filePath); errStat == nil {
+			if !overwrite.confirm(filePath) {
+				fmt.Fprintf(os.Stderr, "Skipping '%s'\n", filePath)
+				continue
+			}
+		}
+
+		if header.Typeflag == tar.TypeSymlink {
+			err = writeSymlink(destRoot, filePath, header.Linkname, header.Name)
+		} else {
+			err = writeTarEntry(filePath, header, reader)
+		}
+		if err != nil {
+			return
+		}
+	}
+	fmt.Fprintf(os.Stderr, "\n")
+	return
+}
+
+// writeTarEntry writes the content of a regular file entry to filePath and
+// restores its mode bits and mtime
+func writeTarEntry(filePath string, header *tar.Header, r io.Reader) (err error) {
+	perm := header.FileInfo().Mode().Perm()
+	dstFile, err := createExtractedFile(filePath, perm)
+	if err != nil {
+		return
+	}
+	_, err = io.Copy(dstFile, r)
+	if errClose := dstFile.Close(); err == nil {
+		err = errClose
+	}
+	if err != nil {
+		return
+	}
+	// the mode given to OpenFile is masked by the umask and ignored for
+	// existing files
+	if err = os.Chmod(filePath, perm); err != nil {
+		return
+	}
+	return os.Chtimes(filePath, header.ModTime, header.ModTime)
+}
+
+// writeSymlink recreates the symlink of archive entry name at filePath,
+// refusing link targets that would point outside of destRoot once the links
+// already extracted are resolved. Targets must be relative, with ".." only
+// at their start, so that resolving them doesn't depend on links they go
+// through.
+func writeSymlink(destRoot string, filePath string, linkname string, name string) (err error) {
+	target := filepath.FromSlash(linkname)
+	if filepath.IsAbs(target) || filepath.VolumeName(target) != "" || strings.HasPrefix(target, string(os.PathSeparator)) {
+		return fmt.Errorf("invalid link target %s for %s: %w", linkname, name, ErrOutsideRoot)
+	}
+	descending := false
+	for _, segment := range strings.Split(filepath.ToSlash(target), "/") {
+		if segment == ".." && descending {
+			return fmt.Errorf("invalid link target %s for %s: %w", linkname, name, ErrOutsideRoot)
+		}
+		descending = descending || (segment != ".." && segment != "." && segment != "")
+	}
+	parent, err := resolveExisting(filepath.Dir(filePath))
+	if err != nil {
+		return
+	}
+	if err = checkInsideRoot(destRoot, filepath.Join(parent, target)); err != nil {
+		return fmt.Errorf("invalid link target %s for %s: %w", linkname, name, err)
+	}
+	if err = os.Remove(filePath); err != nil && !os.IsNotExist(err) {
+		return
+	}
+	return os.Symlink(target, filePath)
+}
+
+// checkInsideRoot returns an error wrapping ErrOutsideRoot if path isn't
+// inside root once the symlinks already on disk are resolved, so that an
+// archive can't write through a link it extracted earlier
+func checkInsideRoot(root string, path string) error {
+	resolvedRoot, err := resolveExisting(root)
+	if err != nil {
+		return err
+	}
+	resolved, err := resolveExisting(path)
+	if err != nil {
+		return err
+	}
+	if !IsSubpath(resolvedRoot, resolved) {
+		return fmt.Errorf("'%s' resolves to '%s': %w", path, resolved, ErrOutsideRoot)
+	}
+	return nil
+}
+
+// resolveExisting returns path made absolute, with the symlinks of its
+// longest prefix that exists on disk resolved
+func resolveExisting(path string) (resolved string, err error) {
+	existing, err := filepath.Abs(path)
+	if err != nil {
+		return
+	}
+	rest := ""
+	for {
+		if _, err = os.Lstat(existing); err == nil {
+			break
+		} else if !os.IsNotExist(err) {
+			return
+		}
+		parent := filepath.Dir(existing)
+		if parent == existing {
+			return
+		}
+		rest = filepath.Join(filepath.Base(existing), rest)
+		existing = parent
+	}
+	if resolved, err = filepath.EvalSymlinks(existing); err != nil {
+		return
+	}
+	resolved = filepath.Join(resolved, rest)
+	return
+}
+
+// createExtractedFile creates filePath with mode for an archive entry,
+// replacing a symlink at filePath rather than writing to its target
+func createExtractedFile(filePath string, mode os.FileMode) (*os.File, error) {
+	if stat, err := os.Lstat(filePath); err == nil && stat.Mode()&os.ModeSymlink != 0 {
+		if err = os.Remove(filePath); err != nil {
+			return nil, err
+		}
+	}
+	return os.OpenFile(filePath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+}
+
+// archiveExtension returns the archive extension of fname
+// (".zip", ".tar.gz", ".tgz" or ".tar"), or "" if it is not an archive
+func archiveExtension(fname string) string {
+	lower := strings.ToLower(fname)
+	for _, ext := range []string{".zip", ".tar.gz", ".tgz", ".tar"} {
+		if strings.HasSuffix(lower, ext) {
+			return fname[len(fname)-len(ext):]
+		}
+	}
+	return ""
+}
+
+// CreateArchive archives source into destination, picking the
+// format from the extension of destination
+func CreateArchive(destination string, source string) error {
+	switch strings.ToLower(archiveExtension(destination)) {
+	case ".zip":
+		return ZipDirectory(destination, source)
+	case ".tar.gz", ".tgz":
+		return TarGzDirectory(destination, source)
+	case ".tar":
+		return TarDirectory(destination, source)
+	}
+	return fmt.Errorf("unknown archive format: '%s'", destination)
+}
+
+// ExtractArchive extracts source into destination, picking the
+// format from the extension of source
+func ExtractArchive(destination string, source string) error {
+	switch strings.ToLower(archiveExtension(source)) {
+	case ".zip":
+		return UnzipDirectory(destination, source)
+	case ".tar.gz", ".tgz":
+		return UntarGzDirectory(destination, source)
+	case ".tar":
+		return UntarDirectory(destination, source)
+	}
+	return fmt.Errorf("unknown archive format: '%s'", source)
+}
+
+// LineEndingStyle is the line ending used by NormalizeLineEndings
+type LineEndingStyle int
+
+const (
+	// LineEndingAuto uses the line ending of the host
+	LineEndingAuto LineEndingStyle = iota
+	// LineEndingLF uses "\n" line endings
+	LineEndingLF
+	// LineEndingCRLF uses "\r\n" line endings
+	LineEndingCRLF
+)
+
+// IsTextFile reports whether the content of a file looks like text,
+// based on http.DetectContentType of its first 512 bytes
+func IsTextFile(fname string) (isText bool, err error) {
+	contentType, err := detectContentType(fname)
+	isText = strings.HasPrefix(contentType, "text/")
+	return
+}
+
+// detectContentType returns http.DetectContentType of the first 512 bytes
+// of a file
+func detectContentType(fname string) (contentType string, err error) {
+	f, err := os.Open(fname)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	buffer := make([]byte, 512)
+	n, err := io.ReadFull(f, buffer)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		err = nil
+	}
+	if err != nil {
+		return
+	}
+	contentType = http.DetectContentType(buffer[:n])
+	return
+}
+
+// NormalizeLineEndings rewrites the line endings of a text file in place
+// to the given style. Files that don't look like text are left untouched,
+// as are UTF-16 ones whose line endings are not single bytes.
+func NormalizeLineEndings(fname string, style LineEndingStyle) (err error) {
+	contentType, err := detectContentType(fname)
+	if err != nil || !strings.HasPrefix(contentType, "text/") || strings.Contains(contentType, "utf-16") {
+		return
+	}
+	if style == LineEndingAuto {
+		style = LineEndingLF
+		if runtime.GOOS == "windows" {
+			style = LineEndingCRLF
+		}
+	}
+	stat, err := os.Stat(fname)
+	if err != nil {
+		return
+	}
+	data, err := os.ReadFile(fname)
+	if err != nil {
+		return
+	}
+	normalized := bytes.ReplaceAll(data, []byte("\r\n"), []byte("\n"))
+	if style == LineEndingCRLF {
+		normalized = bytes.ReplaceAll(normalized, []byte("\n"), []byte("\r\n"))
+	}
+	if bytes.Equal(data, normalized) {
+		return
+	}
+	return writeFileAtomic(fname, normalized, stat.Mode().Perm())
+}
+
+// byte order marks removed by StripBOM
+var byteOrderMarks = [][]byte{
+	{0xef, 0xbb, 0xbf}, // UTF-8
+	{0xff, 0xfe},       // UTF-16 little endian
+	{0xfe, 0xff},       // UTF-16 big endian
+}
+
+// StripBOM removes a leading UTF-8 or UTF-16 byte order mark from a file,
+// rewriting it atomically, and reports whether one was removed. Files
+// without a BOM are left untouched.
+func StripBOM(fname string) (stripped bool, err error) {
+	f, err := os.Open(fname)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	stat, err := f.Stat()
+	if err != nil {
+		return
+	}
+	prefix := make([]byte, 3)
+	n, err := io.ReadFull(f, prefix)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		err = nil
+	}
+	if err != nil {
+		return
+	}
+	for _, bom := range byteOrderMarks {
+		if !bytes.HasPrefix(prefix[:n], bom) {
+			continue
+		}
+		if _, err = f.Seek(int64(len(bom)), io.SeekStart); err != nil {
+			return
+		}
+		err = writeAtomic(fname, stat.Mode().Perm(), func(w io.Writer) error {
+			_, err := io.Copy(w, f)
+			// closed before the rename, which Windows refuses on open files
+			f.Close()
+			return err
+		})
+		if err != nil {
+			return
+		}
+		return true, nil
+	}
+	return
+}
+
+// ValidFileName checks if a filename is valid
+// by making sure it has no invisible characters
+func ValidFileName(fname string) (err error) {
+	if err = validFileNameRunes(fname); err != nil {
+		return
+	}
+	// make sure basename does not include ".." or path separators
+	_, basename := filepath.Split(fname)
+	if strings.Contains(basename, "..") {
+		err = fmt.Errorf("basename cannot contain '..': '%s'", basename)
+		return
+	}
+	if strings.Contains(basename, string(os.PathSeparator)) {
+		err = fmt.Errorf("basename cannot contain path separators: '%s'", basename)
+		return
+	}
+	// make sure the filename is not an absolute path
+	if filepath.IsAbs(fname) {
+		err = fmt.Errorf("filename cannot be an absolute path: '%s'", fname)
+		return
 	}
 	return
 }
 
-// GetLocalIPs returns all local ips
-func GetLocalIPs() (ips []string, err error) {
-	addrs, err := net.InterfaceAddrs()
-	if err != nil {
+// maxNameConflicts caps the attempts of NonConflictingName
+const maxNameConflicts = 10000
+
+// NonConflictingName returns fname if it doesn't exist in dir, otherwise
+// the first free name of the form "name (n).ext" like "file (1).txt"
+func NonConflictingName(dir string, fname string) (name string, err error) {
+	if err = ValidFileName(fname); err != nil {
 		return
 	}
-	ips = []string{}
-	for _, address := range addrs {
-		// check the address type and if it is not a loopback the display it
-		if ipnet, ok := address.(*net.IPNet); ok && !ipnet.IP.IsLoopback() {
-			if ipnet.IP.To4() != nil {
-				ips = append(ips, ipnet.IP.String())
-			}
+	if !Exists(filepath.Join(dir, fname)) {
+		return fname, nil
+	}
+	ext := archiveExtension(fname)
+	if ext == "" {
+		ext = filepath.Ext(fname)
+	}
+	stem := strings.TrimSuffix(fname, ext)
+	if stem == "" {
+		// hidden file like ".bashrc"
+		stem, ext = fname, ""
+	}
+	for i := 1; i <= maxNameConflicts; i++ {
+		name = fmt.Sprintf("%s (%d)%s", stem, i, ext)
+		if err = ValidFileName(name); err != nil {
+			return "", err
+		}
+		if !Exists(filepath.Join(dir, name)) {
+			return name, nil
 		}
 	}
-	return
+	return "", fmt.Errorf("could not find a free name for '%s' after %d attempts", fname, maxNameConflicts)
 }
 
-func RandomFileName() (fname string, err error) {
-	f, err := os.CreateTemp(".", "croc-stdin-")
-	if err != nil {
-		return
+// validFileNameRunes makes sure fname doesn't contain unicode or invisible characters
+func validFileNameRunes(fname string) (err error) {
+	for _, r := range fname {
+		if !unicode.IsGraphic(r) {
+			err = fmt.Errorf("non-graphical unicode: %x U+%d in '%x'", string(r), r, fname)
+			return
+		}
+		if !unicode.IsPrint(r) {
+			err = fmt.Errorf("non-printable unicode: %x U+%d in '%x'", string(r), r, fname)
+			return
+		}
 	}
-	fname = f.Name()
-	_ = f.Close()
 	return
 }
 
-func FindOpenPorts(host string, portNumStart, numPorts int) (openPorts []int) {
-	openPorts = []int{}
-	for port := portNumStart; port-portNumStart < 200; port++ {
-		timeout := 100 * time.Millisecond
-		conn, err := net.DialTimeout("tcp", net.JoinHostPort(host, fmt.Sprint(port)), timeout)
-		if conn != nil {
-			conn.Close()
-		} else if err != nil {
-			openPorts = append(openPorts, port)
+// maxFileNameLength is the maximum length of a path segment, in bytes on
+// Unix and in UTF-16 code units on Windows
+const maxFileNameLength = 255
+
+var windowsReservedNames = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true,
+	"COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true,
+	"LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+// ValidFileNameForOS checks if a relative filename is valid on the target
+// operating system goos (as in runtime.GOOS), regardless of the host.
+// Windows rules (reserved names, illegal characters, trailing dots and
+// spaces) apply when goos is "windows", Unix rules otherwise.
+// Case-insensitive collisions are not checked.
+func ValidFileNameForOS(fname string, goos string) (err error) {
+	if err = validFileNameRunes(fname); err != nil {
+		return
+	}
+	isWindows := goos == "windows"
+	separators := "/"
+	if isWindows {
+		separators = `/\`
+	}
+	if strings.IndexAny(fname, separators) == 0 ||
+		(isWindows && len(fname) >= 2 && fname[1] == ':') {
+		err = fmt.Errorf("filename cannot be an absolute path: '%s'", fname)
+		return
+	}
+	segments := strings.FieldsFunc(fname, func(r rune) bool {
+		return strings.ContainsRune(separators, r)
+	})
+	for _, segment := range segments {
+		if segment == ".." {
+			err = fmt.Errorf("filename cannot contain '..': '%s'", fname)
+			return
 		}
-		if len(openPorts) >= numPorts {
+		if !isWindows {
+			if len(segment) > maxFileNameLength {
+				err = fmt.Errorf("name longer than %d bytes: '%s'", maxFileNameLength, segment)
+				return
+			}
+			continue
+		}
+		if len(utf16.Encode([]rune(segment))) > maxFileNameLength {
+			err = fmt.Errorf("name longer than %d characters: '%s'", maxFileNameLength, segment)
+			return
+		}
+		if i := strings.IndexAny(segment, `<>:"|?*`); i >= 0 {
+			err = fmt.Errorf("name cannot contain '%c' on windows: '%s'", segment[i], segment)
+			return
+		}
+		if segment != "." && strings.TrimRight(segment, ". ") != segment {
+			err = fmt.Errorf("name cannot end with a dot or space on windows: '%s'", segment)
+			return
+		}
+		base := strings.ToUpper(strings.TrimRight(strings.SplitN(segment, ".", 2)[0], " "))
+		if windowsReservedNames[base] {
+			err = fmt.Errorf("name is reserved on windows: '%s'", segment)
 			return
 		}
 	}
 	return
 }
 
-// local ip determination
-// https://stackoverflow.com/questions/41240761/check-if-ip-address-is-in-private-network-space
-var privateIPBlocks []*net.IPNet
+// SanitizePath makes a slash separated relative path safe to extract on
+// any platform: characters that are invalid on Windows or unprintable are
+// replaced by "_", trailing dots and spaces are removed, reserved Windows
+// names get a "_" prefix, and "..", "." and empty segments are dropped.
+func SanitizePath(p string) string {
+	return sanitizePath(filepath.ToSlash(p), true)
+}
 
-func init() {
-	for _, cidr := range []string{
-		"127.0.0.0/8",    // IPv4 loopback
-		"10.0.0.0/8",     // RFC1918
-		"172.16.0.0/12",  // RFC1918
-		"192.168.0.0/16", // RFC1918
-		"169.254.0.0/16", // RFC3927 link-local
-		"::1/128",        // IPv6 loopback
-		"fe80::/10",      // IPv6 link-local
-		"fc00::/7",       // IPv6 unique local addr
-	} {
-		_, block, err := net.ParseCIDR(cidr)
-		if err != nil {
-			panic(fmt.Errorf("parse error on %q: %v", cidr, err))
+// sanitizePath is SanitizePath only applying the Windows rules if windows
+// is set, unprintable characters being replaced anyway
+func sanitizePath(p string, windows bool) string {
+	var segments []string
+	for _, segment := range strings.Split(p, "/") {
+		if segment == "" || segment == "." || segment == ".." {
+			continue
 		}
-		privateIPBlocks = append(privateIPBlocks, block)
+		segments = append(segments, sanitizeSegment(segment, windows))
 	}
+	return strings.Join(segments, "/")
 }
 
-func IsLocalIP(ipaddress string) bool {
-	if strings.Contains(ipaddress, "127.0.0.1") {
-		return true
+func sanitizeSegment(segment string, windows bool) string {
+	var b strings.Builder
+	for _, r := range segment {
+		if !unicode.IsGraphic(r) || !unicode.IsPrint(r) || (windows && strings.ContainsRune(`<>:"|?*\`, r)) {
+			r = '_'
+		}
+		b.WriteRune(r)
 	}
-	host, _, _ := net.SplitHostPort(ipaddress)
-	ip := net.ParseIP(host)
-	if ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() {
-		return true
+	if !windows {
+		return b.String()
 	}
-	for _, block := range privateIPBlocks {
-		if block.Contains(ip) {
-			return true
+	sanitized := strings.TrimRight(b.String(), ". ")
+	if sanitized == "" {
+		return "_"
+	}
+	base := strings.ToUpper(strings.TrimRight(strings.SplitN(sanitized, ".", 2)[0], " "))
+	if windowsReservedNames[base] {
+		sanitized = "_" + sanitized
+	}
+	return sanitized
+}
+
+// SanitizeZipEntry makes the name and mode of a zip entry safe to extract:
+// the name is made relative and its segments sanitized, on Windows like
+// SanitizePath does with "\\" taken as a separator and a drive letter
+// dropped, elsewhere only replacing unprintable characters. The setuid,
+// setgid and sticky bits are cleared from the mode. Names trying to escape
+// the destination with ".." between either separator, or left empty, are
+// rejected on every OS.
+func SanitizeZipEntry(name string, mode os.FileMode) (safeName string, safeMode os.FileMode, err error) {
+	return sanitizeZipEntryForOS(name, mode, runtime.GOOS)
+}
+
+// sanitizeZipEntryForOS is SanitizeZipEntry for the operating system goos
+func sanitizeZipEntryForOS(name string, mode os.FileMode, goos string) (safeName string, safeMode os.FileMode, err error) {
+	for _, segment := range strings.FieldsFunc(name, func(r rune) bool { return r == '/' || r == '\\' }) {
+		if segment == ".." {
+			return "", 0, fmt.Errorf("zip entry '%s' escapes the destination", name)
 		}
 	}
-	return false
+	isWindows := goos == "windows"
+	slashed := name
+	if isWindows {
+		slashed = strings.ReplaceAll(name, "\\", "/")
+		if len(slashed) >= 2 && slashed[1] == ':' && unicode.IsLetter(rune(slashed[0])) {
+			slashed = slashed[2:]
+		}
+	}
+	safeName = sanitizePath(slashed, isWindows)
+	if safeName == "" {
+		return "", 0, fmt.Errorf("zip entry '%s' has no name", name)
+	}
+	safeMode = mode &^ (os.ModeSetuid | os.ModeSetgid | os.ModeSticky)
+	return
 }
 
-func ZipDirectory(destination string, source string) (err error) {
-	if _, err = os.Stat(destination); err == nil {
-		log.Errorf("%s file already exists!\n", destination)
+// ArchiveMemberName returns the archive member name of absPath: a clean,
+// forward slash separated path relative to baseDir, sanitized with
+// SanitizePath. absPath must be inside baseDir.
+func ArchiveMemberName(absPath string, baseDir string) (name string, err error) {
+	if !IsSubpath(baseDir, absPath) {
+		return "", fmt.Errorf("'%s' is not inside '%s'", absPath, baseDir)
 	}
-	fmt.Fprintf(os.Stderr, "Zipping %s to %s\n", source, destination)
-	file, err := os.Create(destination)
+	relPath, err := filepath.Rel(baseDir, absPath)
 	if err != nil {
-		log.Error(err)
+		return
 	}
-	defer file.Close()
-	writer := zip.NewWriter(file)
-	// no compression because croc does its compression on the fly
-	writer.RegisterCompressor(zip.Deflate, func(out io.Writer) (io.WriteCloser, error) {
-		return flate.NewWriter(out, flate.NoCompression)
-	})
-	defer writer.Close()
-	err = filepath.Walk(source, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			log.Error(err)
+	name = SanitizePath(relPath)
+	if name == "" {
+		return "", fmt.Errorf("'%s' has no name relative to '%s'", absPath, baseDir)
+	}
+	return
+}
+
+const crocRemovalFile = "croc-marked-files.txt"
+
+// markedFilesHeader starts the first line of the list of files to remove,
+// followed by the SHA-256 of the rest of the list
+const markedFilesHeader = "# sha256:"
+
+// markedFilesMutex serializes the updates of the list of files to remove
+var markedFilesMutex sync.Mutex
+
+// errMarkedFilesCorrupted is returned when the checksum of the list of
+// files to remove doesn't match its content
+var errMarkedFilesCorrupted = errors.New(crocRemovalFile + " is corrupted, not removing the files it lists")
+
+func MarkFileForRemoval(fname string) {
+	MarkFilesForRemoval(fname)
+}
+
+// MarkFilesForRemoval adds fnames to the list of files to remove in a single
+// rewrite of the list, which is cheaper than marking them one by one. A
+// corrupted list is moved aside with a timestamp suffix rather than lost.
+func MarkFilesForRemoval(fnames ...string) {
+	if len(fnames) == 0 {
+		return
+	}
+	markedFilesMutex.Lock()
+	defer markedFilesMutex.Unlock()
+	// append the fnames to the list of files to remove
+	marked, err := readMarkedFiles()
+	if errors.Is(err, errMarkedFilesCorrupted) {
+		// keep the corrupted list around rather than losing its entries
+		quarantine := fmt.Sprintf("%s.corrupted-%s", crocRemovalFile, time.Now().Format("20060102T150405.000000000"))
+		if _, err = os.Lstat(quarantine); err == nil {
+			log.Warnf("not marking %v for removal: %s already exists", fnames, quarantine)
+			return
 		}
-		if info.Mode().IsRegular() {
-			f1, err := os.Open(path)
-			if err != nil {
-				log.Error(err)
-			}
-			defer f1.Close()
-			zipPath := strings.ReplaceAll(path, source, strings.TrimSuffix(destination, ".zip"))
-			zipPath = filepath.ToSlash(zipPath)
-			w1, err := writer.Create(zipPath)
-			if err != nil {
-				log.Error(err)
-			}
-			if _, err := io.Copy(w1, f1); err != nil {
-				log.Error(err)
-			}
-			fmt.Fprintf(os.Stderr, "\r\033[2K")
-			fmt.Fprintf(os.Stderr, "\rAdding %s", zipPath)
+		if err = os.Rename(crocRemovalFile, quarantine); err != nil {
+			log.Debug(err)
+			return
 		}
-		return nil
-	})
-	if err != nil {
-		log.Error(err)
+		log.Warnf("moved corrupted %s to %s, starting a new list", crocRemovalFile, quarantine)
+	} else if err != nil && !os.IsNotExist(err) {
+		log.Warnf("not marking %v for removal: %v", fnames, err)
+		return
+	}
+	marked = append(marked, fnames...)
+	if err = writeFileAtomic(crocRemovalFile, encodeMarkedFiles(marked), 0o600); err != nil {
+		log.Debug(err)
 	}
-	fmt.Fprintf(os.Stderr, "\n")
-	return nil
 }
 
-func UnzipDirectory(destination string, source string) error {
-	archive, err := zip.OpenReader(source)
+func RemoveMarkedFiles() (err error) {
+	return RemoveMarkedFilesContext(context.Background())
+}
+
+// RemoveMarkedFilesContext removes the files marked for removal like
+// RemoveMarkedFiles. If ctx is cancelled partway, the list is rewritten
+// with only the entries not yet removed so a later run continues cleanly.
+// Nothing is removed if the checksum of the list doesn't match, as a
+// corrupted list could name the wrong files.
+func RemoveMarkedFilesContext(ctx context.Context) (err error) {
+	markedFilesMutex.Lock()
+	defer markedFilesMutex.Unlock()
+	// read the file and remove all the files
+	fnames, err := readMarkedFiles()
 	if err != nil {
-		log.Error(err)
+		if !os.IsNotExist(err) {
+			log.Warn(err)
+		}
+		return
 	}
-	defer archive.Close()
-
-	for _, f := range archive.File {
-		filePath := filepath.Join(destination, f.Name)
-		fmt.Fprintf(os.Stderr, "\r\033[2K")
-		fmt.Fprintf(os.Stderr, "\rUnzipping file %s", filePath)
-		// Issue #593 conceal path traversal vulnerability
-		// make sure the filepath does not have ".."
-		filePath = filepath.Clean(filePath)
-		if strings.Contains(filePath, "..") {
-			log.Errorf("Invalid file path %s\n", filePath)
+	for i, fname := range fnames {
+		if errCtx := ctx.Err(); errCtx != nil {
+			return rewriteMarkedFiles(fnames[i:], errCtx)
 		}
-		if f.FileInfo().IsDir() {
-			os.MkdirAll(filePath, os.ModePerm)
-			continue
+		err = os.Remove(fname)
+		if err == nil {
+			log.Tracef("Removed %s", fname)
 		}
+	}
+	os.Remove(crocRemovalFile)
+	return
+}
 
-		if err := os.MkdirAll(filepath.Dir(filePath), os.ModePerm); err != nil {
-			log.Error(err)
+// readMarkedFiles returns the files listed for removal, after checking the
+// checksum of the list. A list written before the checksum was added is
+// only accepted when nothing in it looks like a header and every line is a
+// plausible path, minus a last line cut off without its newline; it gets
+// the checksum on the next rewrite.
+func readMarkedFiles() (fnames []string, err error) {
+	data, err := os.ReadFile(crocRemovalFile)
+	if err != nil {
+		return
+	}
+	body := string(data)
+	if strings.HasPrefix(body, "#") {
+		var header string
+		header, body, _ = strings.Cut(body, "\n")
+		sum := sha256.Sum256([]byte(body))
+		if header != markedFilesHeader+hex.EncodeToString(sum[:]) {
+			return nil, errMarkedFilesCorrupted
 		}
-
-		// check if file exists
-		if _, err := os.Stat(filePath); err == nil {
-			prompt := fmt.Sprintf("\nOverwrite '%s'? (y/N) ", filePath)
-			choice := strings.ToLower(GetInput(prompt))
-			if choice != "y" && choice != "yes" {
-				fmt.Fprintf(os.Stderr, "Skipping '%s'\n", filePath)
-				continue
+	} else {
+		body = body[:strings.LastIndex(body, "\n")+1]
+		for _, fname := range strings.Split(body, "\n") {
+			if !isLegacyMarkedFile(fname) {
+				return nil, errMarkedFilesCorrupted
 			}
 		}
-
-		dstFile, err := os.OpenFile(filePath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, f.Mode())
-		if err != nil {
-			log.Error(err)
+	}
+	for _, fname := range strings.Split(body, "\n") {
+		if fname != "" {
+			fnames = append(fnames, fname)
 		}
+	}
+	return
+}
 
-		fileInArchive, err := f.Open()
-		if err != nil {
-			log.Error(err)
+// isLegacyMarkedFile reports whether line can be an entry of a list written
+// before the checksum was added, which only held valid paths
+func isLegacyMarkedFile(line string) bool {
+	if strings.Contains(line, "sha256:") || !utf8.ValidString(line) {
+		return false
+	}
+	for _, r := range line {
+		if unicode.IsControl(r) {
+			return false
 		}
+	}
+	return true
+}
 
-		if _, err := io.Copy(dstFile, fileInArchive); err != nil {
-			log.Error(err)
+// encodeMarkedFiles returns the list of files to remove with its checksum
+func encodeMarkedFiles(fnames []string) []byte {
+	var b strings.Builder
+	for _, fname := range fnames {
+		if fname != "" {
+			b.WriteString(fname + "\n")
 		}
+	}
+	sum := sha256.Sum256([]byte(b.String()))
+	return []byte(markedFilesHeader + hex.EncodeToString(sum[:]) + "\n" + b.String())
+}
 
-		dstFile.Close()
-		fileInArchive.Close()
+// rewriteMarkedFiles atomically replaces the list of files to remove with
+// fnames and returns cause, or the error that prevented the rewrite
+func rewriteMarkedFiles(fnames []string, cause error) error {
+	if err := writeFileAtomic(crocRemovalFile, encodeMarkedFiles(fnames), 0o600); err != nil {
+		return err
 	}
-	fmt.Fprintf(os.Stderr, "\n")
-	return nil
+	return cause
 }
 
-// ValidFileName checks if a filename is valid
-// by making sure it has no invisible characters
-func ValidFileName(fname string) (err error) {
-	// make sure it doesn't contain unicode or invisible characters
-	for _, r := range fname {
-		if !unicode.IsGraphic(r) {
-			err = fmt.Errorf("non-graphical unicode: %x U+%d in '%x'", string(r), r, fname)
-			return
-		}
-		if !unicode.IsPrint(r) {
-			err = fmt.Errorf("non-printable unicode: %x U+%d in '%x'", string(r), r, fname)
-			return
-		}
+// writeFileAtomic writes data to a temporary file next to fname and renames
+// it over fname, so readers never see a partially written file
+func writeFileAtomic(fname string, data []byte, perm os.FileMode) (err error) {
+	return writeAtomic(fname, perm, func(w io.Writer) error {
+		_, err := w.Write(data)
+		return err
+	})
+}
+
+// writeAtomic is writeFileAtomic with the content written by write, the
+// temporary file being removed if it fails
+func writeAtomic(fname string, perm os.FileMode, write func(w io.Writer) error) (err error) {
+	f, err := os.CreateTemp(filepath.Dir(fname), "."+filepath.Base(fname)+".tmp")
+	if err != nil {
+		return
 	}
-	// make sure basename does not include ".." or path separators
-	_, basename := filepath.Split(fname)
-	if strings.Contains(basename, "..") {
-		err = fmt.Errorf("basename cannot contain '..': '%s'", basename)
+	tmpName := f.Name()
+	defer func() {
+		if err != nil {
+			os.Remove(tmpName)
+		}
+	}()
+	if err = write(f); err != nil {
+		f.Close()
 		return
 	}
-	if strings.Contains(basename, string(os.PathSeparator)) {
-		err = fmt.Errorf("basename cannot contain path separators: '%s'", basename)
+	if err = f.Close(); err != nil {
 		return
 	}
-	// make sure the filename is not an absolute path
-	if filepath.IsAbs(fname) {
-		err = fmt.Errorf("filename cannot be an absolute path: '%s'", fname)
+	if err = os.Chmod(tmpName, perm); err != nil {
 		return
 	}
-	return
+	return os.Rename(tmpName, fname)
 }
 
-const crocRemovalFile = "croc-marked-files.txt"
+// stdin is where TeeStdinToFile reads from, replaced in tests
+var stdin io.Reader = os.Stdin
 
-func MarkFileForRemoval(fname string) {
-	// append the fname to the list of files to remove
-	f, err := os.OpenFile(crocRemovalFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+// TeeStdinToFile saves standard input to destPath while hashing it, in a
+// single pass, returning the digest and the number of bytes read. The file
+// is written atomically so a failed copy leaves no partial file behind.
+func TeeStdinToFile(destPath string, algorithm string) (digest []byte, size int64, err error) {
+	h, err := newHasher(algorithm)
 	if err != nil {
-		log.Debug(err)
 		return
 	}
-	defer f.Close()
-	_, err = f.WriteString(fname + "\n")
-}
-
-func RemoveMarkedFiles() (err error) {
-	// read the file and remove all the files
-	f, err := os.Open(crocRemovalFile)
-	if err != nil {
+	err = writeAtomic(destPath, 0o644, func(w io.Writer) (err error) {
+		size, err = io.Copy(io.MultiWriter(w, h), stdin)
 		return
+	})
+	if err != nil {
+		return nil, 0, err
 	}
-	defer f.Close()
-	scanner := bufio.NewScanner(f)
-	for scanner.Scan() {
-		fname := scanner.Text()
-		err = os.Remove(fname)
-		if err == nil {
+	digest = h.Sum(nil)
+	return
+}
+
+// TempTracker records files created during a single transfer (like the
+// stdin temp file) so they can all be removed together. Unlike
+// MarkFileForRemoval, nothing is persisted to disk. It is safe for
+// concurrent use and its zero value is ready to use.
+type TempTracker struct {
+	sync.Mutex
+	paths []string
+}
+
+// Track records fname for removal on Cleanup
+func (t *TempTracker) Track(fname string) {
+	t.Lock()
+	defer t.Unlock()
+	t.paths = append(t.paths, fname)
+}
+
+// Cleanup removes all tracked files and forgets them. Files that no
+// longer exist are ignored, the first other error is returned.
+func (t *TempTracker) Cleanup() (err error) {
+	t.Lock()
+	defer t.Unlock()
+	for _, fname := range t.paths {
+		errRemove := os.Remove(fname)
+		if errRemove == nil {
 			log.Tracef("Removed %s", fname)
+		} else if !os.IsNotExist(errRemove) && err == nil {
+			err = errRemove
 		}
 	}
-	os.Remove(crocRemovalFile)
+	t.paths = nil
 	return
 }
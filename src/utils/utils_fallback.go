@@ -0,0 +1,12 @@
+//go:build !linux && !windows
+// +build !linux,!windows
+
+package utils
+
+import "os"
+
+// preallocate sets the size of f, which leaves a sparse file where the
+// platform has no portable way to reserve the space up front
+func preallocate(f *os.File, size int64) error {
+	return f.Truncate(size)
+}
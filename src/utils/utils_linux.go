@@ -0,0 +1,74 @@
+//go:build linux
+// +build linux
+
+package utils
+
+import (
+	"fmt"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// filesystem magic numbers from statfs(2)
+var networkFilesystems = map[uint32]string{
+	0x6969:     "nfs",
+	0x517b:     "smb",
+	0xff534d42: "cifs",
+	0xfe534d42: "smb2",
+	0x564c:     "ncp",
+	0x73757245: "coda",
+	0x5346414f: "afs",
+	0x00c36400: "ceph",
+	0x01021997: "9p",
+	0x01161970: "gfs2",
+	0x7461636f: "ocfs2",
+	0x0bd00bd0: "lustre",
+}
+
+var localFilesystems = map[uint32]string{
+	0xef53:     "ext4",
+	0x01021994: "tmpfs",
+	0x58465342: "xfs",
+	0x9123683e: "btrfs",
+	0x794c7630: "overlayfs",
+	0x2fc12fc1: "zfs",
+	0x65735546: "fuse",
+	0x4d44:     "vfat",
+	0x5346544e: "ntfs",
+	0xf15f:     "ecryptfs",
+}
+
+// IsNetworkFilesystem reports whether path is on a network filesystem
+// (NFS, CIFS, ...) by checking the filesystem type returned by statfs,
+// along with the name of that type
+func IsNetworkFilesystem(path string) (isNetwork bool, fsType string, err error) {
+	stat := unix.Statfs_t{}
+	if err = unix.Statfs(path, &stat); err != nil {
+		return
+	}
+	magic := uint32(stat.Type)
+	if fsType, isNetwork = networkFilesystems[magic]; isNetwork {
+		return
+	}
+	fsType, ok := localFilesystems[magic]
+	if !ok {
+		fsType = fmt.Sprintf("0x%x", magic)
+	}
+	return
+}
+
+// preallocate reserves size bytes on disk for f with fallocate, falling
+// back to truncating when the filesystem doesn't support it
+func preallocate(f *os.File, size int64) error {
+	for {
+		err := unix.Fallocate(int(f.Fd()), 0, 0, size)
+		switch err {
+		case unix.EINTR:
+			continue
+		case unix.EOPNOTSUPP, unix.ENOSYS:
+			return f.Truncate(size)
+		}
+		return err
+	}
+}
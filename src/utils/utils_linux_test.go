@@ -0,0 +1,63 @@
+package utils
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/sys/unix"
+)
+
+func TestIsNetworkFilesystem(t *testing.T) {
+	isNetwork, fsType, err := IsNetworkFilesystem(t.TempDir())
+	assert.Nil(t, err)
+	assert.False(t, isNetwork)
+	assert.NotEmpty(t, fsType)
+
+	_, _, err = IsNetworkFilesystem("/does/not/exist")
+	assert.NotNil(t, err)
+}
+
+func TestPreallocateFile(t *testing.T) {
+	dir := t.TempDir()
+	fname := filepath.Join(dir, "prealloc")
+	const size = 4 << 20
+	assert.Nil(t, PreallocateFile(fname, size))
+	stat, err := os.Stat(fname)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(size), stat.Size())
+
+	// existing content is kept, a larger file is shrunk
+	assert.Nil(t, os.WriteFile(fname, []byte("hello"), 0o644))
+	assert.Nil(t, PreallocateFile(fname, size))
+	b, err := os.ReadFile(fname)
+	assert.Nil(t, err)
+	assert.Equal(t, "hello", string(b[:5]))
+	assert.Equal(t, size, len(b))
+	assert.Nil(t, PreallocateFile(fname, 3))
+	b, err = os.ReadFile(fname)
+	assert.Nil(t, err)
+	assert.Equal(t, "hel", string(b))
+
+	assert.NotNil(t, PreallocateFile(fname, -1))
+
+	f, err := os.Create(filepath.Join(dir, "probe"))
+	assert.Nil(t, err)
+	errProbe := unix.Fallocate(int(f.Fd()), 0, 0, 4096)
+	f.Close()
+	if errProbe != nil {
+		t.Skip("filesystem doesn't support fallocate")
+	}
+
+	// blocks are really reserved rather than left sparse
+	assert.Nil(t, PreallocateFile(fname, size))
+	stat, err = os.Stat(fname)
+	assert.Nil(t, err)
+	assert.GreaterOrEqual(t, stat.Sys().(*syscall.Stat_t).Blocks*512, int64(size))
+
+	// far more than any disk holds fails up front instead of mid-transfer
+	err = PreallocateFile(filepath.Join(dir, "huge"), 1<<50)
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,17 @@
+//go:build !linux
+// +build !linux
+
+package utils
+
+import "os"
+
+// IsNetworkFilesystem reports whether path is on a network filesystem.
+// The filesystem type is only detected on Linux, elsewhere this only checks
+// that path exists and reports a local filesystem of unknown type.
+func IsNetworkFilesystem(path string) (isNetwork bool, fsType string, err error) {
+	if _, err = os.Stat(path); err != nil {
+		return
+	}
+	fsType = "unknown"
+	return
+}
@@ -1,14 +1,33 @@
 package utils
 
 import (
+	"archive/tar"
+	"archive/zip"
 	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/binary"
 	"fmt"
+	"hash/crc32"
+	"io"
 	"log"
+	"math"
 	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"os/user"
 	"path"
+	"path/filepath"
+	"runtime"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -84,6 +103,42 @@ func TestExists(t *testing.T) {
 	assert.False(t, Exists("doesnotexist"))
 }
 
+func TestExistsErr(t *testing.T) {
+	dir := t.TempDir()
+	fname := filepath.Join(dir, "file")
+	assert.Nil(t, os.WriteFile(fname, []byte("hello"), 0o644))
+
+	exists, err := ExistsErr(fname)
+	assert.Nil(t, err)
+	assert.True(t, exists)
+
+	exists, err = ExistsErr(filepath.Join(dir, "missing"))
+	assert.Nil(t, err)
+	assert.False(t, exists)
+
+	// a path below a regular file can't be stat'ed but isn't NotExist either
+	if runtime.GOOS != "windows" {
+		exists, err = ExistsErr(filepath.Join(fname, "child"))
+		assert.NotNil(t, err)
+		assert.False(t, exists)
+		assert.False(t, Exists(filepath.Join(fname, "child")))
+	}
+
+	if runtime.GOOS == "windows" || os.Geteuid() == 0 {
+		t.Skip("directory modes don't restrict this user")
+	}
+	locked := filepath.Join(dir, "locked")
+	assert.Nil(t, os.Mkdir(locked, 0o755))
+	assert.Nil(t, os.WriteFile(filepath.Join(locked, "secret"), []byte("x"), 0o644))
+	assert.Nil(t, os.Chmod(locked, 0o600))
+	defer os.Chmod(locked, 0o755)
+
+	exists, err = ExistsErr(filepath.Join(locked, "secret"))
+	assert.True(t, os.IsPermission(err))
+	assert.False(t, exists)
+	assert.False(t, Exists(filepath.Join(locked, "secret")))
+}
+
 func TestMD5HashFile(t *testing.T) {
 	bigFile()
 	defer os.Remove("bigfile.test")
@@ -122,16 +177,83 @@ func TestXXHashFile(t *testing.T) {
 	assert.NotNil(t, err)
 }
 
+func TestSHA1HashFile(t *testing.T) {
+	bigFile()
+	defer os.Remove("bigfile.test")
+	b, err := SHA1HashFile("bigfile.test", false)
+	assert.Nil(t, err)
+	content, err := os.ReadFile("bigfile.test")
+	assert.Nil(t, err)
+	expected := sha1.Sum(content)
+	assert.Equal(t, expected[:], b)
+	b, err = HashFile("bigfile.test", "sha1")
+	assert.Nil(t, err)
+	assert.Equal(t, expected[:], b)
+	b, err = SHA1HashFile("bigfile.test", true)
+	assert.Nil(t, err)
+	assert.Equal(t, expected[:], b)
+	_, err = SHA1HashFile("bigfile.test.nofile", false)
+	assert.NotNil(t, err)
+	_, err = SHA1HashFile("bigfile.test.nofile", true)
+	assert.NotNil(t, err)
+}
+
+func TestSHA512HashFile(t *testing.T) {
+	bigFile()
+	defer os.Remove("bigfile.test")
+	b, err := SHA512HashFile("bigfile.test", false)
+	assert.Nil(t, err)
+	content, err := os.ReadFile("bigfile.test")
+	assert.Nil(t, err)
+	expected := sha512.Sum512(content)
+	assert.Equal(t, expected[:], b)
+	b, err = HashFile("bigfile.test", "sha512")
+	assert.Nil(t, err)
+	assert.Equal(t, expected[:], b)
+	b, err = SHA512HashFile("bigfile.test", true)
+	assert.Nil(t, err)
+	assert.Equal(t, expected[:], b)
+	_, err = SHA512HashFile("bigfile.test.nofile", false)
+	assert.NotNil(t, err)
+	_, err = SHA512HashFile("bigfile.test.nofile", true)
+	assert.NotNil(t, err)
+}
+
 func TestSHA256(t *testing.T) {
 	assert.Equal(t, "09ca7e4eaa6e8ae9c7d261167129184883644d07dfba7cbfbc4c8a2e08360d5b", SHA256("hello, world"))
 }
 
+func TestHashEqual(t *testing.T) {
+	assert.True(t, HashEqual([]byte{1, 2, 3}, []byte{1, 2, 3}))
+	assert.False(t, HashEqual([]byte{1, 2, 3}, []byte{1, 2, 4}))
+	assert.False(t, HashEqual([]byte{1, 2, 3}, []byte{1, 2}))
+	assert.True(t, HashEqual(nil, []byte{}))
+}
+
 func TestByteCountDecimal(t *testing.T) {
 	assert.Equal(t, "10.0 kB", ByteCountDecimal(10240))
 	assert.Equal(t, "50 B", ByteCountDecimal(50))
 	assert.Equal(t, "12.4 MB", ByteCountDecimal(13002343))
 }
 
+func TestByteCountIEC(t *testing.T) {
+	assert.Equal(t, "50 B", ByteCountIEC(50))
+	assert.Equal(t, "1023 B", ByteCountIEC(1023))
+	assert.Equal(t, "1.0 KiB", ByteCountIEC(1024))
+	assert.Equal(t, "10.0 KiB", ByteCountIEC(10240))
+	assert.Equal(t, "12.4 MiB", ByteCountIEC(13002343))
+	assert.Equal(t, "1.0 GiB", ByteCountIEC(1<<30))
+}
+
+func TestByteCountSI(t *testing.T) {
+	assert.Equal(t, "50 B", ByteCountSI(50))
+	assert.Equal(t, "999 B", ByteCountSI(999))
+	assert.Equal(t, "1.0 kB", ByteCountSI(1000))
+	assert.Equal(t, "10.2 kB", ByteCountSI(10240))
+	assert.Equal(t, "13.0 MB", ByteCountSI(13002343))
+	assert.Equal(t, "1.1 GB", ByteCountSI(1<<30))
+}
+
 func TestMissingChunks(t *testing.T) {
 	fileSize := 100
 	chunkSize := 10
@@ -215,12 +337,105 @@ func TestPublicIP(t *testing.T) {
 	assert.Nil(t, err)
 }
 
+func TestPublicIPs(t *testing.T) {
+	serve := func(body string) string {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, body)
+		}))
+		t.Cleanup(server.Close)
+		return server.URL
+	}
+	defer func(v4 []string, v6 string) { publicIPProviders, publicIPv6URL = v4, v6 }(publicIPProviders, publicIPv6URL)
+
+	publicIPProviders = []string{serve("203.0.113.7\n")}
+	publicIPv6URL = serve("2001:db8::7\n")
+	ip, err := PublicIPv6()
+	assert.Nil(t, err)
+	assert.Equal(t, "2001:db8::7", ip)
+	ipv4, ipv6, err := PublicIPs()
+	assert.Nil(t, err)
+	assert.Equal(t, "203.0.113.7", ipv4)
+	assert.Equal(t, "2001:db8::7", ipv6)
+
+	// an IPv4 only host
+	publicIPv6URL = serve("<html>error</html>")
+	_, err = PublicIPv6()
+	assert.NotNil(t, err)
+	ipv4, ipv6, err = PublicIPs()
+	assert.Nil(t, err)
+	assert.Equal(t, "203.0.113.7", ipv4)
+	assert.Empty(t, ipv6)
+
+	publicIPv6URL = serve("203.0.113.7")
+	_, err = PublicIPv6()
+	assert.NotNil(t, err)
+
+	publicIPProviders = []string{serve("")}
+	_, _, err = PublicIPs()
+	assert.NotNil(t, err)
+}
+
+func TestPublicIPContext(t *testing.T) {
+	hung := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-hung:
+		case <-r.Context().Done():
+		}
+	}))
+	defer server.Close()
+	defer close(hung)
+	defer func(v4 []string) { publicIPProviders = v4 }(publicIPProviders)
+	publicIPProviders = []string{server.URL, server.URL}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err := PublicIPContext(ctx)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Less(t, time.Since(start), publicIPTimeout)
+}
+
+func TestPublicIPFrom(t *testing.T) {
+	serve := func(status int, body string) string {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(status)
+			fmt.Fprint(w, body)
+		}))
+		t.Cleanup(server.Close)
+		return server.URL
+	}
+	down := serve(http.StatusBadGateway, "<html>502 Bad Gateway</html>")
+	up := serve(http.StatusOK, " 203.0.113.7\n")
+	other := serve(http.StatusOK, "198.51.100.1")
+
+	ip, err := PublicIPFrom([]string{down, "http://127.0.0.1:1", up, other})
+	assert.Nil(t, err)
+	assert.Equal(t, "203.0.113.7", ip)
+
+	_, err = PublicIPFrom([]string{down})
+	assert.NotNil(t, err)
+	_, err = PublicIPFrom(nil)
+	assert.NotNil(t, err)
+}
+
 func TestLocalIP(t *testing.T) {
 	ip := LocalIP()
 	fmt.Println(ip)
 	assert.True(t, strings.Contains(ip, ".") || strings.Contains(ip, ":"))
 }
 
+func TestLocalIPErr(t *testing.T) {
+	ip, err := LocalIPErr()
+	if err != nil {
+		assert.Empty(t, ip)
+		assert.Empty(t, LocalIP())
+		return
+	}
+	assert.NotNil(t, net.ParseIP(ip))
+	assert.Equal(t, ip, LocalIP())
+}
+
 func TestGetRandomName(t *testing.T) {
 	name := GetRandomName()
 	fmt.Println(name)
@@ -247,8 +462,49 @@ func TestFindOpenPorts(t *testing.T) {
 	}
 }
 
+func TestFindOpenPortsRange(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer listener.Close()
+	busy := listener.Addr().(*net.TCPAddr).Port
+
+	// the window is exhausted before enough ports are found
+	openPorts := FindOpenPortsRange("127.0.0.1", busy, 10, 3)
+	assert.LessOrEqual(t, len(openPorts), 2)
+	assert.NotContains(t, openPorts, busy)
+	for _, port := range openPorts {
+		assert.Less(t, port, busy+3)
+	}
+	assert.Empty(t, FindOpenPortsRange("127.0.0.1", busy, 10, 0))
+}
+
+func TestFindOpenPortsContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.Empty(t, FindOpenPortsContext(ctx, "127.0.0.1", 9009, 4))
+
+	// cancelled after two ports were checked
+	openPorts := FindOpenPortsContext(&cancelAfter{Context: context.Background(), n: 2}, "127.0.0.1", 40000, 10)
+	assert.LessOrEqual(t, len(openPorts), 2)
+
+	openPorts = FindOpenPortsContext(context.Background(), "127.0.0.1", 40000, 3)
+	assert.Len(t, openPorts, 3)
+}
+
 func TestIsLocalIP(t *testing.T) {
 	assert.True(t, IsLocalIP("192.168.0.14:9009"))
+	assert.True(t, IsLocalIP("192.168.1.5"))
+	assert.True(t, IsLocalIP("10.0.0.1"))
+	assert.True(t, IsLocalIP("fe80::1"))
+	assert.True(t, IsLocalIP("fc00::5"))
+	assert.True(t, IsLocalIP("[fc00::5]:9009"))
+	assert.True(t, IsLocalIP("[::1]:9009"))
+	assert.True(t, IsLocalIP("[::1]"))
+	assert.False(t, IsLocalIP("8.8.8.8"))
+	assert.False(t, IsLocalIP("8.8.8.8:9009"))
+	assert.False(t, IsLocalIP("2001:4860:4860::8888"))
+	assert.False(t, IsLocalIP("[2001:4860:4860::8888]:9009"))
+	assert.False(t, IsLocalIP("not an ip"))
 }
 
 func TestValidFileName(t *testing.T) {
@@ -265,3 +521,2866 @@ func TestValidFileName(t *testing.T) {
 	assert.NotNil(t, ValidFileName("hi..txt"))
 	assert.NotNil(t, ValidFileName(path.Join(string(os.PathSeparator), "abs", string(os.PathSeparator), "hi.txt")))
 }
+
+func TestHashFileLogical(t *testing.T) {
+	content := []byte("temporary file's content")
+	unpadded, err := os.CreateTemp("", "unpadded")
+	assert.Nil(t, err)
+	defer os.Remove(unpadded.Name())
+	unpadded.Write(content)
+	unpadded.Close()
+
+	padded, err := os.CreateTemp("", "padded")
+	assert.Nil(t, err)
+	defer os.Remove(padded.Name())
+	padded.Write(content)
+	padded.Write(make([]byte, 1000))
+	padded.Close()
+
+	for _, algorithm := range []string{"md5", "xxhash", "highway", "imohash"} {
+		expected, err := HashFile(unpadded.Name(), algorithm)
+		assert.Nil(t, err)
+		hashed, err := HashFileLogical(padded.Name(), algorithm, int64(len(content)))
+		assert.Nil(t, err)
+		assert.Equal(t, expected, hashed, algorithm)
+		full, err := HashFile(padded.Name(), algorithm)
+		assert.Nil(t, err)
+		assert.NotEqual(t, expected, full, algorithm)
+	}
+
+	_, err = HashFileLogical(unpadded.Name(), "xxhash", int64(len(content)+1))
+	assert.NotNil(t, err)
+	_, err = HashFileLogical(unpadded.Name(), "nope", int64(len(content)))
+	assert.NotNil(t, err)
+}
+
+func TestTempTracker(t *testing.T) {
+	dir := t.TempDir()
+	var tracker TempTracker
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		fname := filepath.Join(dir, fmt.Sprintf("tracked%d", i))
+		assert.Nil(t, os.WriteFile(fname, []byte("x"), 0o644))
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			tracker.Track(fname)
+		}()
+	}
+	// tracked but never created
+	tracker.Track(filepath.Join(dir, "missing"))
+	untracked := filepath.Join(dir, "untracked")
+	assert.Nil(t, os.WriteFile(untracked, []byte("x"), 0o644))
+	wg.Wait()
+
+	assert.Nil(t, tracker.Cleanup())
+	entries, err := os.ReadDir(dir)
+	assert.Nil(t, err)
+	assert.Len(t, entries, 1)
+	assert.Equal(t, "untracked", entries[0].Name())
+	// nothing left to clean
+	assert.Nil(t, tracker.Cleanup())
+}
+
+func TestNextChunkBatch(t *testing.T) {
+	missing := ChunkRangesToChunks([]int64{10, 0, 1, 40, 2, 70, 3, 200, 5})
+	seen := make(map[int64]int)
+	remaining := missing
+	batches := 0
+	for len(remaining) > 0 {
+		var batch []int64
+		batch, remaining = NextChunkBatch(remaining, 4)
+		assert.LessOrEqual(t, len(batch), 4)
+		assert.NotEmpty(t, batch)
+		for _, chunk := range batch {
+			seen[chunk]++
+		}
+		batches++
+	}
+	assert.Equal(t, 3, batches)
+	assert.Len(t, seen, len(missing))
+	for _, chunk := range missing {
+		assert.Equal(t, 1, seen[chunk])
+	}
+
+	batch, remaining := NextChunkBatch(missing, 0)
+	assert.Equal(t, missing, batch)
+	assert.Empty(t, remaining)
+	batch, remaining = NextChunkBatch(nil, 4)
+	assert.Empty(t, batch)
+	assert.Empty(t, remaining)
+}
+
+func TestRemoveMarkedFilesTruncated(t *testing.T) {
+	for _, fname := range []string{"marked1.test", "marked2.test", "marked3"} {
+		assert.Nil(t, os.WriteFile(fname, []byte("x"), 0o644))
+		defer os.Remove(fname)
+	}
+	// the last entry was cut off while "marked3.test" was being written
+	list := encodeMarkedFiles([]string{"marked1.test", "marked2.test", "marked3.test"})
+	assert.Nil(t, os.WriteFile(crocRemovalFile, list[:len(list)-6], 0o600))
+	defer os.Remove(crocRemovalFile)
+
+	assert.NotNil(t, RemoveMarkedFiles())
+	assert.True(t, Exists("marked1.test"))
+	assert.True(t, Exists("marked2.test"))
+	assert.True(t, Exists("marked3"))
+	assert.True(t, Exists(crocRemovalFile))
+}
+
+func TestMarkFileForRemoval(t *testing.T) {
+	fnames := []string{"marked1.test", "marked2.test", "marked3.test"}
+	for _, fname := range fnames {
+		assert.Nil(t, os.WriteFile(fname, []byte("x"), 0o644))
+		defer os.Remove(fname)
+		MarkFileForRemoval(fname)
+	}
+	defer os.Remove(crocRemovalFile)
+	b, err := os.ReadFile(crocRemovalFile)
+	assert.Nil(t, err)
+	assert.Equal(t, encodeMarkedFiles(fnames), b)
+
+	// an edited list is not acted upon
+	corrupted := strings.Replace(string(b), "marked2.test", "marked3.test", 1)
+	assert.Nil(t, os.WriteFile(crocRemovalFile, []byte(corrupted), 0o600))
+	err = RemoveMarkedFiles()
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "corrupted")
+	for _, fname := range fnames {
+		assert.True(t, Exists(fname))
+	}
+
+	assert.Nil(t, os.WriteFile(crocRemovalFile, b, 0o600))
+	assert.Nil(t, RemoveMarkedFiles())
+	for _, fname := range fnames {
+		assert.False(t, Exists(fname))
+	}
+	assert.False(t, Exists(crocRemovalFile))
+}
+
+func TestMarkFileForRemovalLegacyList(t *testing.T) {
+	fnames := []string{"marked1.test", "marked2.test", "marked3.test", "marked4"}
+	for _, fname := range fnames {
+		assert.Nil(t, os.WriteFile(fname, []byte("x"), 0o644))
+		defer os.Remove(fname)
+	}
+	// a list from an older version, without the checksum and with the last
+	// entry cut off while "marked4.test" was being appended
+	assert.Nil(t, os.WriteFile(crocRemovalFile, []byte("marked1.test\nmarked2.test\nmarked4"), 0o600))
+	defer os.Remove(crocRemovalFile)
+
+	MarkFileForRemoval("marked3.test")
+	b, err := os.ReadFile(crocRemovalFile)
+	assert.Nil(t, err)
+	assert.Equal(t, encodeMarkedFiles(fnames[:3]), b)
+
+	assert.Nil(t, RemoveMarkedFiles())
+	for _, fname := range fnames[:3] {
+		assert.False(t, Exists(fname))
+	}
+	assert.True(t, Exists("marked4"))
+	assert.False(t, Exists(crocRemovalFile))
+}
+
+func TestMarkFileForRemovalKeepsCorruptedList(t *testing.T) {
+	defer os.Remove(crocRemovalFile)
+	var lists [][]byte
+	for _, fnames := range [][]string{{"marked1.test", "marked2.test"}, {"marked3.test"}} {
+		corrupted := encodeMarkedFiles(fnames)
+		corrupted = corrupted[:len(corrupted)-3]
+		lists = append(lists, corrupted)
+		assert.Nil(t, os.WriteFile(crocRemovalFile, corrupted, 0o600))
+		MarkFilesForRemoval("marked4.test", "marked5.test")
+		b, err := os.ReadFile(crocRemovalFile)
+		assert.Nil(t, err)
+		assert.Equal(t, encodeMarkedFiles([]string{"marked4.test", "marked5.test"}), b)
+	}
+
+	// every corrupted list is kept
+	quarantined, err := filepath.Glob(crocRemovalFile + ".corrupted-*")
+	assert.Nil(t, err)
+	for _, fname := range quarantined {
+		defer os.Remove(fname)
+	}
+	assert.Len(t, quarantined, len(lists))
+	for _, fname := range quarantined {
+		b, err := os.ReadFile(fname)
+		assert.Nil(t, err)
+		assert.Contains(t, lists, b)
+	}
+}
+
+func TestRemoveMarkedFilesUnverifiedList(t *testing.T) {
+	assert.Nil(t, os.WriteFile("marked1.test", []byte("x"), 0o644))
+	defer os.Remove("marked1.test")
+	defer os.Remove(crocRemovalFile)
+	list := encodeMarkedFiles([]string{"marked1.test"})
+	header, _, _ := strings.Cut(string(list), "\n")
+	for _, corrupted := range []string{
+		// the header was cut off or damaged, which must not pass as a
+		// list from before the checksum
+		header[:5],
+		header[:20] + "\nmarked1.test\n",
+		"x" + string(list[1:]),
+		"\nmarked1.test\n" + string(list),
+		// not something an older version could have written
+		"marked1.test\n\x00\x01\n",
+	} {
+		assert.Nil(t, os.WriteFile(crocRemovalFile, []byte(corrupted), 0o600))
+		assert.NotNil(t, RemoveMarkedFiles(), "%q", corrupted)
+		assert.True(t, Exists("marked1.test"))
+	}
+}
+
+func TestTarDirectoryKeepsModesMtimesAndSymlinks(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("symlinks and mode bits need Unix")
+	}
+	dir := t.TempDir()
+	source := "tartest"
+	assert.Nil(t, os.MkdirAll(filepath.Join(source, "sub"), 0o755))
+	defer os.RemoveAll(source)
+	script := filepath.Join(source, "run.sh")
+	assert.Nil(t, os.WriteFile(script, []byte("#!/bin/sh\n"), 0o755))
+	mtime := time.Date(2020, 2, 3, 4, 5, 6, 0, time.UTC)
+	assert.Nil(t, os.Chtimes(script, mtime, mtime))
+	assert.Nil(t, os.Symlink(filepath.Join("..", "run.sh"), filepath.Join(source, "sub", "link")))
+
+	for _, gzipped := range []bool{false, true} {
+		archive := "tartest.tar"
+		create, extract := TarDirectory, UntarDirectory
+		if gzipped {
+			archive += ".gz"
+			create, extract = TarGzDirectory, UntarGzDirectory
+		}
+		assert.Nil(t, create(archive, source))
+		defer os.Remove(archive)
+		dest := t.TempDir()
+		assert.Nil(t, extract(dest, archive))
+
+		extracted := filepath.Join(dest, "tartest")
+		stat, err := os.Stat(filepath.Join(extracted, "run.sh"))
+		assert.Nil(t, err)
+		assert.Equal(t, os.FileMode(0o755), stat.Mode().Perm())
+		assert.True(t, stat.ModTime().Equal(mtime))
+		link, err := os.Readlink(filepath.Join(extracted, "sub", "link"))
+		assert.Nil(t, err)
+		assert.Equal(t, filepath.Join("..", "run.sh"), link)
+	}
+
+	// a link pointing outside of the destination is refused
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	assert.Nil(t, tw.WriteHeader(&tar.Header{Name: "evil", Typeflag: tar.TypeSymlink, Linkname: "../../etc/passwd"}))
+	assert.Nil(t, tw.Close())
+	evil := filepath.Join(dir, "evil.tar")
+	assert.Nil(t, os.WriteFile(evil, buf.Bytes(), 0o644))
+	dest := t.TempDir()
+	assert.NotNil(t, UntarDirectory(dest, evil))
+	_, err := os.Lstat(filepath.Join(dest, "evil"))
+	assert.True(t, os.IsNotExist(err))
+
+	// so is a chain of links that each look harmless on their own, and
+	// files aren't written through a link leaving the destination
+	buf.Reset()
+	tw = tar.NewWriter(&buf)
+	for _, header := range []*tar.Header{
+		{Name: "s", Typeflag: tar.TypeSymlink, Linkname: "."},
+		{Name: "s/s/inside.txt", Typeflag: tar.TypeReg, Mode: 0o644, Size: 2},
+		{Name: "s/s/s/t", Typeflag: tar.TypeSymlink, Linkname: "../../.."},
+		{Name: "t/pwned.txt", Typeflag: tar.TypeReg, Mode: 0o644, Size: 2},
+	} {
+		assert.Nil(t, tw.WriteHeader(header))
+		if header.Typeflag == tar.TypeReg {
+			_, err = tw.Write([]byte("hi"))
+			assert.Nil(t, err)
+		}
+	}
+	assert.Nil(t, tw.Close())
+	assert.Nil(t, os.WriteFile(evil, buf.Bytes(), 0o644))
+	parent := t.TempDir()
+	dest = filepath.Join(parent, "a", "b")
+	assert.Nil(t, os.MkdirAll(filepath.Join(dest, "out"), 0o755))
+	assert.NotNil(t, UntarDirectory(dest, evil))
+	assert.True(t, Exists(filepath.Join(dest, "inside.txt")))
+	assertOnlyWrittenIn(t, parent, dest)
+
+	buf.Reset()
+	tw = tar.NewWriter(&buf)
+	assert.Nil(t, tw.WriteHeader(&tar.Header{Name: "out/pwned.txt", Typeflag: tar.TypeReg, Mode: 0o644, Size: 2}))
+	_, err = tw.Write([]byte("hi"))
+	assert.Nil(t, err)
+	assert.Nil(t, tw.Close())
+	assert.Nil(t, os.WriteFile(evil, buf.Bytes(), 0o644))
+	assert.Nil(t, os.RemoveAll(filepath.Join(dest, "out")))
+	assert.Nil(t, os.Symlink(parent, filepath.Join(dest, "out")))
+	assert.NotNil(t, UntarDirectory(dest, evil))
+	assertOnlyWrittenIn(t, parent, dest)
+}
+
+func TestCreateExtractArchive(t *testing.T) {
+	assert.Nil(t, os.MkdirAll(path.Join("archivetest", "sub"), 0o755))
+	defer os.RemoveAll("archivetest")
+	assert.Nil(t, os.WriteFile(path.Join("archivetest", "a.txt"), []byte("hello"), 0o644))
+	assert.Nil(t, os.WriteFile(path.Join("archivetest", "sub", "b.txt"), []byte("world"), 0o644))
+
+	for _, archive := range []string{"archivetest.zip", "archivetest.tar.gz", "archivetest.tgz", "archivetest.tar"} {
+		assert.Nil(t, CreateArchive(archive, "archivetest"), archive)
+		defer os.Remove(archive)
+		dest := t.TempDir()
+		assert.Nil(t, ExtractArchive(dest, archive), archive)
+		b, err := os.ReadFile(path.Join(dest, "archivetest", "a.txt"))
+		assert.Nil(t, err, archive)
+		assert.Equal(t, "hello", string(b), archive)
+		b, err = os.ReadFile(path.Join(dest, "archivetest", "sub", "b.txt"))
+		assert.Nil(t, err, archive)
+		assert.Equal(t, "world", string(b), archive)
+	}
+
+	// extracting into the current directory works too
+	archive, err := filepath.Abs("archivetest.tar")
+	assert.Nil(t, err)
+	t.Chdir(t.TempDir())
+	assert.Nil(t, ExtractArchive(".", archive))
+	b, err := os.ReadFile(path.Join("archivetest", "sub", "b.txt"))
+	assert.Nil(t, err)
+	assert.Equal(t, "world", string(b))
+	t.Chdir(filepath.Dir(archive))
+
+	err = CreateArchive("archivetest.rar", "archivetest")
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "unknown archive format")
+	assert.False(t, Exists("archivetest.rar"))
+	err = ExtractArchive(t.TempDir(), "archivetest.7z")
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "unknown archive format")
+}
+
+func TestChunkBitset(t *testing.T) {
+	fileSize := 95
+	chunkSize := 10
+	rand.Seed(1)
+	bigBuff := make([]byte, fileSize)
+	rand.Read(bigBuff)
+	fname := path.Join(t.TempDir(), "bitset.test")
+	os.WriteFile(fname, bigBuff, 0o644)
+	empty := make([]byte, chunkSize)
+	f, err := os.OpenFile(fname, os.O_RDWR, 0o644)
+	assert.Nil(t, err)
+	for block := 0; block < fileSize/chunkSize; block++ {
+		if block == 0 || block == 4 || block == 5 || block >= 7 {
+			f.WriteAt(empty, int64(block*chunkSize))
+		}
+	}
+	f.Close()
+
+	bitset, err := ChunkBitset(fname, int64(fileSize), chunkSize)
+	assert.Nil(t, err)
+	// 10 chunks, the last one partial
+	assert.Len(t, bitset, 2)
+	assert.Equal(t, []int64{1, 2, 3, 6, 9}, ChunkBitsetPresent(bitset, 10))
+
+	missing := []int64{}
+	for _, offset := range ChunkRangesToChunks(MissingChunks(fname, int64(fileSize), chunkSize)) {
+		missing = append(missing, offset/int64(chunkSize))
+	}
+	assert.Equal(t, missing, ChunkBitsetMissing(bitset, 10))
+
+	bitset, err = ChunkBitset(fname+"nofile", int64(fileSize), chunkSize)
+	assert.Nil(t, err)
+	assert.Empty(t, ChunkBitsetPresent(bitset, 10))
+	bitset, err = ChunkBitset(fname, int64(fileSize+10), chunkSize)
+	assert.Nil(t, err)
+	assert.Empty(t, ChunkBitsetPresent(bitset, 11))
+	_, err = ChunkBitset(fname, int64(fileSize), 0)
+	assert.NotNil(t, err)
+}
+
+func TestValidFileNameForOS(t *testing.T) {
+	// valid on linux, invalid on windows
+	for _, fname := range []string{"what?.txt", "a<b>.txt", "CON", "con.txt", "LPT1.tar.gz", "trailing.", "trailing ", "dir/aux/file.txt"} {
+		assert.Nil(t, ValidFileNameForOS(fname, "linux"), fname)
+		assert.NotNil(t, ValidFileNameForOS(fname, "windows"), fname)
+	}
+	// too many bytes for linux but few enough UTF-16 characters for windows
+	long := strings.Repeat("中", 100) + ".txt"
+	assert.NotNil(t, ValidFileNameForOS(long, "linux"))
+	assert.Nil(t, ValidFileNameForOS(long, "windows"))
+	assert.NotNil(t, ValidFileNameForOS(strings.Repeat("a", 256), "windows"))
+
+	for _, goos := range []string{"linux", "darwin", "windows"} {
+		assert.Nil(t, ValidFileNameForOS("中文.csl", goos))
+		assert.Nil(t, ValidFileNameForOS("dir/[something].csl", goos))
+		assert.Nil(t, ValidFileNameForOS("console.txt", goos))
+		assert.NotNil(t, ValidFileNameForOS("D中文.cslouglas​", goos))
+		assert.NotNil(t, ValidFileNameForOS("../hi.txt", goos))
+		assert.NotNil(t, ValidFileNameForOS("/abs/hi.txt", goos))
+	}
+	assert.NotNil(t, ValidFileNameForOS(`C:\abs\hi.txt`, "windows"))
+	assert.NotNil(t, ValidFileNameForOS(`dir\..\hi.txt`, "windows"))
+	assert.Nil(t, ValidFileNameForOS(`dir\..\hi.txt`, "linux"))
+}
+
+func TestProcessFileChunks(t *testing.T) {
+	fname := path.Join(t.TempDir(), "chunks.test")
+	content := bytes.Repeat([]byte("abcdefg"), 15)
+	assert.Nil(t, os.WriteFile(fname, content, 0o644))
+
+	var total int64
+	var offsets []int64
+	err := ProcessFileChunks(fname, 10, func(offset int64, chunk []byte) error {
+		assert.Equal(t, content[offset:offset+int64(len(chunk))], chunk)
+		offsets = append(offsets, offset)
+		total += int64(len(chunk))
+		return nil
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, int64(len(content)), total)
+	assert.Len(t, offsets, 11)
+	assert.Equal(t, int64(100), offsets[10])
+
+	// stops at the first error
+	calls := 0
+	errAbort := fmt.Errorf("abort")
+	err = ProcessFileChunks(fname, 10, func(offset int64, chunk []byte) error {
+		calls++
+		if offset == 30 {
+			return errAbort
+		}
+		return nil
+	})
+	assert.Equal(t, errAbort, err)
+	assert.Equal(t, 4, calls)
+
+	assert.NotNil(t, ProcessFileChunks(fname+"nofile", 10, func(int64, []byte) error { return nil }))
+	assert.NotNil(t, ProcessFileChunks(fname, 0, func(int64, []byte) error { return nil }))
+}
+
+func TestEstimateCompressibility(t *testing.T) {
+	dir := t.TempDir()
+	text := path.Join(dir, "text.test")
+	assert.Nil(t, os.WriteFile(text, bytes.Repeat([]byte("the quick brown fox jumps over the lazy dog\n"), 5000), 0o644))
+	ratio, err := EstimateCompressibility(text, 64*1024)
+	assert.Nil(t, err)
+	assert.Less(t, ratio, 0.1)
+
+	random := path.Join(dir, "random.test")
+	randomBytes := make([]byte, 200000)
+	rand.Read(randomBytes)
+	assert.Nil(t, os.WriteFile(random, randomBytes, 0o644))
+	ratio, err = EstimateCompressibility(random, 64*1024)
+	assert.Nil(t, err)
+	assert.Greater(t, ratio, 0.95)
+
+	empty := path.Join(dir, "empty.test")
+	assert.Nil(t, os.WriteFile(empty, nil, 0o644))
+	ratio, err = EstimateCompressibility(empty, 64*1024)
+	assert.Nil(t, err)
+	assert.Equal(t, 1.0, ratio)
+
+	_, err = EstimateCompressibility(path.Join(dir, "nofile"), 64*1024)
+	assert.NotNil(t, err)
+}
+
+func TestZipDirectoryReproducible(t *testing.T) {
+	assert.Nil(t, os.MkdirAll(path.Join("reprotest", "sub"), 0o755))
+	defer os.RemoveAll("reprotest")
+	assert.Nil(t, os.WriteFile(path.Join("reprotest", "b.txt"), []byte("hello"), 0o644))
+	assert.Nil(t, os.WriteFile(path.Join("reprotest", "a.txt"), []byte("world"), 0o644))
+	assert.Nil(t, os.WriteFile(path.Join("reprotest", "sub", "c.txt"), []byte("!"), 0o644))
+	defer os.Remove("reprotest.zip")
+
+	assert.Nil(t, ZipDirectoryReproducible("reprotest.zip", "reprotest"))
+	first, err := os.ReadFile("reprotest.zip")
+	assert.Nil(t, err)
+
+	// touching the files must not change the archive
+	later := time.Now().Add(time.Hour)
+	for _, fname := range []string{"a.txt", "b.txt", path.Join("sub", "c.txt")} {
+		assert.Nil(t, os.Chtimes(path.Join("reprotest", fname), later, later))
+	}
+	assert.Nil(t, ZipDirectoryReproducible("reprotest.zip", "reprotest"))
+	second, err := os.ReadFile("reprotest.zip")
+	assert.Nil(t, err)
+	assert.Equal(t, first, second)
+
+	dest := t.TempDir()
+	assert.Nil(t, UnzipDirectory(dest, "reprotest.zip"))
+	b, err := os.ReadFile(path.Join(dest, "reprotest", "sub", "c.txt"))
+	assert.Nil(t, err)
+	assert.Equal(t, "!", string(b))
+}
+
+func TestIsSubpath(t *testing.T) {
+	assert.True(t, IsSubpath("/a", "/a"))
+	assert.True(t, IsSubpath("/a", "/a/b/c"))
+	assert.True(t, IsSubpath("/a", "/a/..b"))
+	assert.False(t, IsSubpath("/a", "/ab"))
+	assert.False(t, IsSubpath("/a/b", "/a"))
+	assert.False(t, IsSubpath("/a", "/a/../b"))
+}
+
+func TestLinksEscaping(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("creating symlinks requires privileges on windows")
+	}
+	dir := t.TempDir()
+	root := filepath.Join(dir, "root")
+	assert.Nil(t, os.MkdirAll(filepath.Join(root, "sub"), 0o755))
+	assert.Nil(t, os.WriteFile(filepath.Join(root, "inside.txt"), []byte("x"), 0o644))
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "outside.txt"), []byte("x"), 0o644))
+	assert.Nil(t, os.Symlink(filepath.Join("..", "inside.txt"), filepath.Join(root, "sub", "inlink")))
+	assert.Nil(t, os.Symlink(filepath.Join(dir, "outside.txt"), filepath.Join(root, "outlink")))
+	assert.Nil(t, os.Symlink(filepath.Join("..", "..", "missing"), filepath.Join(root, "sub", "dangling")))
+
+	links, err := LinksEscaping(root)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{filepath.Join(root, "outlink"), filepath.Join(root, "sub", "dangling")}, links)
+
+	_, err = LinksEscaping(filepath.Join(dir, "nodir"))
+	assert.NotNil(t, err)
+}
+
+func TestNormalizeCode(t *testing.T) {
+	assert.Equal(t, "1234-apple-river", NormalizeCode("  1234-Apple-River\n"))
+	assert.Equal(t, "1234-apple-river", NormalizeCode("1234 apple  river"))
+	assert.Equal(t, "", NormalizeCode("   "))
+}
+
+func TestCodeEqualConstantTime(t *testing.T) {
+	assert.True(t, CodeEqualConstantTime("1234-apple-river", "1234-apple-river"))
+	assert.True(t, CodeEqualConstantTime("1234-apple-river", " 1234 Apple River "))
+	assert.True(t, CodeEqualConstantTime("", ""))
+	assert.False(t, CodeEqualConstantTime("1234-apple-river", "1234-apple-rivet"))
+	assert.False(t, CodeEqualConstantTime("1234-apple-river", "1234-apple-river-extra"))
+	assert.False(t, CodeEqualConstantTime("1234-apple-river", "1234"))
+	assert.False(t, CodeEqualConstantTime("", "1234"))
+}
+
+func TestCodeSimilarity(t *testing.T) {
+	assert.Equal(t, 1.0, CodeSimilarity("1234-apple-river", "1234-apple-river"))
+	assert.Equal(t, 1.0, CodeSimilarity("1234-apple-river", " 1234 Apple River "))
+	assert.Equal(t, 1.0, CodeSimilarity("", ""))
+	assert.Less(t, CodeSimilarity("abcd", "wxyz"), 0.01)
+	assert.Equal(t, 0.0, CodeSimilarity("", "1234"))
+	assert.Greater(t, CodeSimilarity("1234-apple-river", "1234-apple-rivet"), 0.9)
+
+	assert.True(t, IsConfusinglySimilar("1234-apple-river", "1235-apple-river", 0.9))
+	assert.False(t, IsConfusinglySimilar("1234-apple-river", "9876-grape-ocean", 0.9))
+	// a code is as confusing as it gets with itself
+	assert.True(t, IsConfusinglySimilar("1234-apple-river", "1234-apple-river", 0.9))
+	assert.True(t, IsConfusinglySimilar("1234-apple-river", " 1234 Apple River", 1))
+}
+
+func TestChunksToServe(t *testing.T) {
+	local := []byte{0b10110101, 0b00000011}
+	peer := []byte{0b00100001, 0b00000010}
+	indices, err := ChunksToServe(local, peer)
+	assert.Nil(t, err)
+	assert.Equal(t, []int64{2, 4, 7, 8}, indices)
+
+	indices, err = ChunksToServe(peer, local)
+	assert.Nil(t, err)
+	assert.Empty(t, indices)
+
+	_, err = ChunksToServe(local, []byte{0})
+	assert.NotNil(t, err)
+}
+
+// cancelAfter is a context that becomes cancelled after n calls to Err
+type cancelAfter struct {
+	context.Context
+	n int
+}
+
+func (c *cancelAfter) Err() error {
+	if c.n <= 0 {
+		return context.Canceled
+	}
+	c.n--
+	return nil
+}
+
+func TestRemoveMarkedFilesContext(t *testing.T) {
+	fnames := []string{"marked1.test", "marked2.test", "marked3.test", "marked4.test"}
+	for _, fname := range fnames {
+		assert.Nil(t, os.WriteFile(fname, []byte("x"), 0o644))
+		defer os.Remove(fname)
+	}
+	assert.Nil(t, os.WriteFile(crocRemovalFile, encodeMarkedFiles(fnames), 0o600))
+	defer os.Remove(crocRemovalFile)
+
+	err := RemoveMarkedFilesContext(&cancelAfter{Context: context.Background(), n: 2})
+	assert.Equal(t, context.Canceled, err)
+	assert.False(t, Exists("marked1.test"))
+	assert.False(t, Exists("marked2.test"))
+	assert.True(t, Exists("marked3.test"))
+	assert.True(t, Exists("marked4.test"))
+	b, err := os.ReadFile(crocRemovalFile)
+	assert.Nil(t, err)
+	assert.Equal(t, encodeMarkedFiles([]string{"marked3.test", "marked4.test"}), b)
+
+	// a later run continues where the cancelled one stopped
+	assert.Nil(t, RemoveMarkedFiles())
+	assert.False(t, Exists("marked3.test"))
+	assert.False(t, Exists("marked4.test"))
+	assert.False(t, Exists(crocRemovalFile))
+}
+
+func TestNormalizeLineEndings(t *testing.T) {
+	dir := t.TempDir()
+	text := filepath.Join(dir, "text.txt")
+	assert.Nil(t, os.WriteFile(text, []byte("line one\r\nline two\r\nlast line"), 0o640))
+
+	assert.Nil(t, NormalizeLineEndings(text, LineEndingLF))
+	b, err := os.ReadFile(text)
+	assert.Nil(t, err)
+	assert.Equal(t, "line one\nline two\nlast line", string(b))
+	stat, err := os.Stat(text)
+	assert.Nil(t, err)
+	if runtime.GOOS != "windows" {
+		assert.Equal(t, os.FileMode(0o640), stat.Mode().Perm())
+	}
+
+	assert.Nil(t, NormalizeLineEndings(text, LineEndingCRLF))
+	b, err = os.ReadFile(text)
+	assert.Nil(t, err)
+	assert.Equal(t, "line one\r\nline two\r\nlast line", string(b))
+
+	binary := filepath.Join(dir, "binary.png")
+	content := append([]byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR\r\n"), 0, 1, 2, '\n', 3)
+	assert.Nil(t, os.WriteFile(binary, content, 0o644))
+	assert.Nil(t, NormalizeLineEndings(binary, LineEndingLF))
+	b, err = os.ReadFile(binary)
+	assert.Nil(t, err)
+	assert.Equal(t, content, b)
+
+	// UTF-16 is text, but inserting single "\r" bytes would corrupt it
+	for _, bom := range [][]byte{{0xff, 0xfe}, {0xfe, 0xff}} {
+		utf16Text := filepath.Join(dir, fmt.Sprintf("utf16-%x.txt", bom))
+		content := append(bom, 'a', 0, '\n', 0, 0, 'b', 0, '\n')
+		assert.Nil(t, os.WriteFile(utf16Text, content, 0o644))
+		isText, err := IsTextFile(utf16Text)
+		assert.Nil(t, err)
+		assert.True(t, isText)
+		assert.Nil(t, NormalizeLineEndings(utf16Text, LineEndingCRLF))
+		b, err = os.ReadFile(utf16Text)
+		assert.Nil(t, err)
+		assert.Equal(t, content, b)
+	}
+
+	entries, err := os.ReadDir(dir)
+	assert.Nil(t, err)
+	assert.Len(t, entries, 4)
+	assert.NotNil(t, NormalizeLineEndings(filepath.Join(dir, "nofile"), LineEndingLF))
+}
+
+func TestSessionFingerprint(t *testing.T) {
+	code := "1234-apple-river-stone"
+	fingerprint := SessionFingerprint(code)
+	assert.Len(t, strings.Split(fingerprint, "-"), 2)
+	assert.Equal(t, fingerprint, SessionFingerprint(code))
+	assert.Equal(t, fingerprint, SessionFingerprint(" 1234 Apple River Stone"))
+
+	seen := map[string]bool{fingerprint: true}
+	for i := 0; i < 100; i++ {
+		seen[SessionFingerprint(fmt.Sprintf("%s-%d", code, i))] = true
+	}
+	assert.Len(t, seen, 101)
+}
+
+func TestPackSmallFiles(t *testing.T) {
+	src := t.TempDir()
+	var files []string
+	contents := make(map[string][]byte)
+	for i := 0; i < 200; i++ {
+		name := fmt.Sprintf("small%03d.txt", i)
+		content := make([]byte, rand.Intn(64))
+		rand.Read(content)
+		assert.Nil(t, os.WriteFile(filepath.Join(src, name), content, 0o644))
+		files = append(files, filepath.Join(src, name))
+		contents[name] = content
+	}
+
+	var packed bytes.Buffer
+	index, err := PackSmallFiles(files, &packed)
+	assert.Nil(t, err)
+	assert.Len(t, index, len(files))
+
+	dest := t.TempDir()
+	assert.Nil(t, UnpackSmallFiles(bytes.NewReader(packed.Bytes()), index, dest))
+	entries, err := os.ReadDir(dest)
+	assert.Nil(t, err)
+	assert.Len(t, entries, len(files))
+	for name, content := range contents {
+		b, err := os.ReadFile(filepath.Join(dest, name))
+		assert.Nil(t, err)
+		assert.Equal(t, content, b, name)
+	}
+
+	// base names must be unique
+	other := filepath.Join(t.TempDir(), "small000.txt")
+	assert.Nil(t, os.WriteFile(other, []byte("x"), 0o644))
+	_, err = PackSmallFiles([]string{files[0], other}, io.Discard)
+	assert.NotNil(t, err)
+
+	// entries can't escape destDir
+	err = UnpackSmallFiles(bytes.NewReader(packed.Bytes()), []SmallFileEntry{{Name: "../evil", Offset: 0, Length: 1}}, dest)
+	assert.NotNil(t, err)
+	assert.False(t, Exists(filepath.Join(dest, "..", "evil")))
+}
+
+func TestHashDirectoryProgress(t *testing.T) {
+	root := t.TempDir()
+	assert.Nil(t, os.MkdirAll(filepath.Join(root, "sub"), 0o755))
+	var bytesTotal int64
+	for i, fname := range []string{"a.txt", "b.txt", filepath.Join("sub", "c.txt")} {
+		content := bytes.Repeat([]byte("x"), 100*(i+1))
+		bytesTotal += int64(len(content))
+		assert.Nil(t, os.WriteFile(filepath.Join(root, fname), content, 0o644))
+	}
+
+	var calls, lastFilesDone, lastFilesTotal int
+	var lastBytesDone, lastBytesTotal int64
+	hashes, err := HashDirectoryProgress(root, "xxhash", func(filesDone, filesTotal int, bytesDone, bytesTotal int64) {
+		calls++
+		assert.Greater(t, bytesDone, lastBytesDone)
+		lastFilesDone, lastFilesTotal = filesDone, filesTotal
+		lastBytesDone, lastBytesTotal = bytesDone, bytesTotal
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, 3, calls)
+	assert.Equal(t, 3, lastFilesDone)
+	assert.Equal(t, lastFilesTotal, lastFilesDone)
+	assert.Equal(t, bytesTotal, lastBytesDone)
+	assert.Equal(t, bytesTotal, lastBytesTotal)
+
+	assert.Len(t, hashes, 3)
+	expected, err := HashFile(filepath.Join(root, "sub", "c.txt"), "xxhash")
+	assert.Nil(t, err)
+	assert.Equal(t, expected, hashes["sub/c.txt"])
+
+	plain, err := HashDirectory(root, "xxhash")
+	assert.Nil(t, err)
+	assert.Equal(t, hashes, plain)
+}
+
+func TestCanonicalizePaths(t *testing.T) {
+	root := t.TempDir()
+	a := filepath.Join(root, "a")
+	ab := filepath.Join(root, "ab")
+	canonical, err := CanonicalizePaths([]string{
+		filepath.Join(a, "b"),
+		a,
+		a + string(os.PathSeparator),
+		filepath.Join(a, "..", "a", "c", "d"),
+		ab,
+		filepath.Join(root, "z", "file.txt"),
+		filepath.Join(root, "z", "file.txt"),
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{a, ab, filepath.Join(root, "z", "file.txt")}, canonical)
+
+	wd, err := os.Getwd()
+	assert.Nil(t, err)
+	canonical, err = CanonicalizePaths([]string{"x", "./x/y"})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{filepath.Join(wd, "x")}, canonical)
+
+	canonical, err = CanonicalizePaths(nil)
+	assert.Nil(t, err)
+	assert.Empty(t, canonical)
+}
+
+func TestEWMARate(t *testing.T) {
+	e := NewEWMARate(0.1)
+	assert.Equal(t, time.Duration(0), e.ETA(1000))
+	start := time.Now()
+	e.Update(0, start)
+	// bursts of 2 MB every other second average 1 MB/s
+	for i := 1; i <= 100; i++ {
+		var n int64
+		if i%2 == 0 {
+			n = 2000000
+		}
+		e.Update(n, start.Add(time.Duration(i)*time.Second))
+		if i > 50 {
+			assert.InDelta(t, 1000000, e.Rate(), 100000)
+		}
+	}
+	assert.InDelta(t, float64(10*time.Second), float64(e.ETA(10000000)), float64(time.Second))
+
+	// updates at the same instant are folded into the next one
+	e = NewEWMARate(0.5)
+	e.Update(0, start)
+	e.Update(500, start)
+	e.Update(500, start.Add(time.Second))
+	assert.Equal(t, 1000.0, e.Rate())
+}
+
+func TestIsCrocArchive(t *testing.T) {
+	dir := t.TempDir()
+	source := filepath.Join(dir, "crocarchive")
+	assert.Nil(t, os.MkdirAll(source, 0o755))
+	assert.Nil(t, os.WriteFile(filepath.Join(source, "a.txt"), []byte("hello"), 0o644))
+	for i, zipDirectory := range []func(string, string) error{ZipDirectory, ZipDirectoryReproducible, ZipDirectoryResumable} {
+		archive := filepath.Join(dir, fmt.Sprintf("croc%d.zip", i))
+		assert.Nil(t, zipDirectory(archive, source))
+		isCroc, err := IsCrocArchive(archive)
+		assert.Nil(t, err)
+		assert.True(t, isCroc, archive)
+	}
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	w, err := zw.Create("a.txt")
+	assert.Nil(t, err)
+	_, err = w.Write([]byte("hello"))
+	assert.Nil(t, err)
+	assert.Nil(t, zw.Close())
+	plain := filepath.Join(dir, "plain.zip")
+	assert.Nil(t, os.WriteFile(plain, buf.Bytes(), 0o644))
+	isCroc, err := IsCrocArchive(plain)
+	assert.Nil(t, err)
+	assert.False(t, isCroc)
+
+	_, err = IsCrocArchive(filepath.Join(source, "a.txt"))
+	assert.NotNil(t, err)
+}
+
+func TestZipDirectoryErrors(t *testing.T) {
+	dir := t.TempDir()
+	assert.NotNil(t, ZipDirectory(filepath.Join(dir, "missing.zip"), filepath.Join(dir, "missing")))
+	assert.NotNil(t, ZipDirectory(filepath.Join(dir, "nodir", "out.zip"), dir))
+
+	assert.NotNil(t, UnzipDirectory(t.TempDir(), filepath.Join(dir, "missing.zip")))
+	notZip := filepath.Join(dir, "notzip.zip")
+	assert.Nil(t, os.WriteFile(notZip, []byte("not a zip"), 0o644))
+	assert.NotNil(t, UnzipDirectory(t.TempDir(), notZip))
+
+	// a destination that can't be created is reported
+	source := filepath.Join(dir, "errtest")
+	assert.Nil(t, os.MkdirAll(source, 0o755))
+	assert.Nil(t, os.WriteFile(filepath.Join(source, "a.txt"), []byte("hello"), 0o644))
+	archive := filepath.Join(dir, "errtest.zip")
+	assert.Nil(t, ZipDirectory(archive, source))
+	notADir := filepath.Join(dir, "file")
+	assert.Nil(t, os.WriteFile(notADir, nil, 0o644))
+	assert.NotNil(t, UnzipDirectory(notADir, archive))
+}
+
+func TestZipDirectoryKeepsModeAndMtime(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the executable bit needs Unix")
+	}
+	source := "modetest"
+	assert.Nil(t, os.MkdirAll(source, 0o755))
+	defer os.RemoveAll(source)
+	script := filepath.Join(source, "run.sh")
+	assert.Nil(t, os.WriteFile(script, []byte("#!/bin/sh\necho hi\n"), 0o755))
+	assert.Nil(t, os.Chmod(script, 0o755))
+	mtime := time.Date(2021, 6, 7, 8, 9, 10, 0, time.UTC)
+	assert.Nil(t, os.Chtimes(script, mtime, mtime))
+
+	assert.Nil(t, ZipDirectory("modetest.zip", source))
+	defer os.Remove("modetest.zip")
+	dest := t.TempDir()
+	assert.Nil(t, UnzipDirectory(dest, "modetest.zip"))
+
+	stat, err := os.Stat(filepath.Join(dest, "modetest", "run.sh"))
+	assert.Nil(t, err)
+	assert.NotZero(t, stat.Mode().Perm()&0o100, "executable bit lost: %s", stat.Mode())
+	assert.True(t, stat.ModTime().Equal(mtime), stat.ModTime())
+}
+
+func TestZipDirectorySymlinks(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("creating symlinks needs privileges on Windows")
+	}
+	source := "symlinktest"
+	assert.Nil(t, os.MkdirAll(source, 0o755))
+	defer os.RemoveAll(source)
+	assert.Nil(t, os.WriteFile(filepath.Join(source, "target.txt"), []byte("hello"), 0o644))
+	assert.Nil(t, os.Symlink("target.txt", filepath.Join(source, "link.txt")))
+	secret := filepath.Join(t.TempDir(), "id_rsa")
+	assert.Nil(t, os.WriteFile(secret, []byte("secret"), 0o600))
+	assert.Nil(t, os.Symlink(secret, filepath.Join(source, "outside.txt")))
+	assert.Nil(t, os.Symlink("missing.txt", filepath.Join(source, "dangling.txt")))
+	defer os.Remove("symlinktest.zip")
+
+	// by default links inside source are followed, the others skipped
+	assert.Nil(t, ZipDirectory("symlinktest.zip", source))
+	archive, err := zip.OpenReader("symlinktest.zip")
+	assert.Nil(t, err)
+	var names []string
+	for _, f := range archive.File {
+		names = append(names, f.Name)
+	}
+	archive.Close()
+	assert.Equal(t, []string{"symlinktest/link.txt", "symlinktest/target.txt"}, names)
+	dest := t.TempDir()
+	assert.Nil(t, UnzipDirectory(dest, "symlinktest.zip"))
+	stat, err := os.Lstat(filepath.Join(dest, "symlinktest", "link.txt"))
+	assert.Nil(t, err)
+	assert.True(t, stat.Mode().IsRegular())
+	b, err := os.ReadFile(filepath.Join(dest, "symlinktest", "link.txt"))
+	assert.Nil(t, err)
+	assert.Equal(t, "hello", string(b))
+
+	// or stored as a link, only restored when asked for
+	assert.Nil(t, os.Remove("symlinktest.zip"))
+	assert.Nil(t, ZipDirectoryOpts("symlinktest.zip", source, ZipOptions{StoreSymlinks: true}))
+	for _, unzip := range []func(string, string) error{UnzipDirectory, UnzipDirectoryVerified} {
+		dest = t.TempDir()
+		assert.Nil(t, unzip(dest, "symlinktest.zip"))
+		assert.True(t, Exists(filepath.Join(dest, "symlinktest", "target.txt")))
+		_, err = os.Lstat(filepath.Join(dest, "symlinktest", "link.txt"))
+		assert.True(t, os.IsNotExist(err))
+	}
+	dest = t.TempDir()
+	assert.Nil(t, UnzipDirectoryOpts(dest, "symlinktest.zip", UnzipOptions{RestoreSymlinks: true}))
+	link, err := os.Readlink(filepath.Join(dest, "symlinktest", "link.txt"))
+	assert.Nil(t, err)
+	assert.Equal(t, "target.txt", link)
+	b, err = os.ReadFile(filepath.Join(dest, "symlinktest", "link.txt"))
+	assert.Nil(t, err)
+	assert.Equal(t, "hello", string(b))
+
+	// links pointing out of the destination aren't created, even through a
+	// chain of links that each look harmless on their own
+	evil := filepath.Join(t.TempDir(), "evil.zip")
+	writeTestZip(t, evil, []testArchiveEntry{
+		{name: "evil", link: "../../etc/passwd"},
+		{name: "s", link: "."},
+		{name: "s/s/s/t", link: "../../.."},
+		{name: "u", link: "s/../x"},
+		{name: "t/pwned.txt", content: "pwned"},
+	})
+	parent := t.TempDir()
+	dest = filepath.Join(parent, "a", "b")
+	assert.Nil(t, os.MkdirAll(dest, 0o755))
+	assert.Nil(t, UnzipDirectoryOpts(dest, evil, UnzipOptions{RestoreSymlinks: true}))
+	for _, name := range []string{"evil", "u"} {
+		_, err = os.Lstat(filepath.Join(dest, name))
+		assert.True(t, os.IsNotExist(err), name)
+	}
+	// s/s/s/t is dest/t, which was made a directory instead of a link
+	stat, err = os.Lstat(filepath.Join(dest, "t"))
+	assert.Nil(t, err)
+	assert.True(t, stat.IsDir())
+	assertOnlyWrittenIn(t, parent, dest)
+	b, err = os.ReadFile(filepath.Join(dest, "t", "pwned.txt"))
+	assert.Nil(t, err)
+	assert.Equal(t, "pwned", string(b))
+}
+
+// testArchiveEntry is a regular file, or a symlink if link is set, to put
+// in a test archive
+type testArchiveEntry struct {
+	name    string
+	link    string
+	content string
+}
+
+// writeTestZip writes the entries to a zip archive at fname
+func writeTestZip(t *testing.T, fname string, entries []testArchiveEntry) {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, entry := range entries {
+		header := &zip.FileHeader{Name: entry.name, Method: zip.Store}
+		content := entry.content
+		header.SetMode(0o644)
+		if entry.link != "" {
+			header.SetMode(os.ModeSymlink | 0o777)
+			content = entry.link
+		}
+		w, err := zw.CreateHeader(header)
+		assert.Nil(t, err)
+		_, err = w.Write([]byte(content))
+		assert.Nil(t, err)
+	}
+	assert.Nil(t, zw.Close())
+	assert.Nil(t, os.WriteFile(fname, buf.Bytes(), 0o644))
+}
+
+// assertOnlyWrittenIn checks that the only files under root are in dest
+func assertOnlyWrittenIn(t *testing.T, root string, dest string) {
+	var outside []string
+	assert.Nil(t, filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() && !IsSubpath(dest, path) {
+			outside = append(outside, path)
+		}
+		return err
+	}))
+	assert.Empty(t, outside)
+}
+
+func TestZipDirectoryResumable(t *testing.T) {
+	source := "resumetest"
+	assert.Nil(t, os.MkdirAll(filepath.Join(source, "sub"), 0o755))
+	defer os.RemoveAll(source)
+	for i := 0; i < 6; i++ {
+		assert.Nil(t, os.WriteFile(filepath.Join(source, "sub", fmt.Sprintf("%d.txt", i)), []byte(strings.Repeat(fmt.Sprint(i), 1000*(i+1))), 0o644))
+	}
+	archive := "resumetest.zip"
+	for _, fname := range []string{archive, archive + ".partial", archive + ".partial.index", archive + ".partial.new", archive + ".partial.new.index"} {
+		defer os.Remove(fname)
+	}
+
+	defer func() { onZipEntryAdded = func(string) error { return nil } }()
+	var added []string
+	onZipEntryAdded = func(name string) error {
+		added = append(added, name)
+		if len(added) > 3 {
+			return fmt.Errorf("interrupted")
+		}
+		return nil
+	}
+	assert.NotNil(t, ZipDirectoryResumable(archive, source))
+	assert.False(t, Exists(archive))
+
+	// the second run only reads the files that weren't archived yet
+	added = nil
+	onZipEntryAdded = func(name string) error {
+		added = append(added, name)
+		return nil
+	}
+	assert.Nil(t, ZipDirectoryResumable(archive, source))
+	assert.Len(t, added, 3)
+	for _, fname := range []string{archive + ".partial", archive + ".partial.index", archive + ".partial.new", archive + ".partial.new.index"} {
+		assert.False(t, Exists(fname), fname)
+	}
+
+	dest := t.TempDir()
+	assert.Nil(t, UnzipDirectoryVerified(dest, archive))
+	for i := 0; i < 6; i++ {
+		b, err := os.ReadFile(filepath.Join(dest, "resumetest", "sub", fmt.Sprintf("%d.txt", i)))
+		assert.Nil(t, err)
+		assert.Equal(t, strings.Repeat(fmt.Sprint(i), 1000*(i+1)), string(b))
+	}
+}
+
+func TestUnzipDirectoryPathTraversal(t *testing.T) {
+	fname := filepath.Join(t.TempDir(), "slip.zip")
+	chain := []testArchiveEntry{
+		{name: "s", link: "."},
+		{name: "s/s/s/t", link: "../../.."},
+		{name: "t/pwned.txt", content: "pwned"},
+		{name: "out/pwned.txt", content: "pwned"},
+		{name: "ok/file.txt", content: "root:x:0:0"},
+	}
+	writeTestZip(t, fname, append([]testArchiveEntry{
+		{name: "../../etc/passwd", content: "root:x:0:0"},
+		{name: `..\..\etc\passwd`, content: "root:x:0:0"},
+	}, chain...))
+	chainOnly := filepath.Join(t.TempDir(), "chain.zip")
+	writeTestZip(t, chainOnly, chain)
+
+	for i, unzip := range []func(string, string) error{
+		UnzipDirectory,
+		func(dest, fname string) error {
+			return UnzipDirectoryOpts(dest, fname, UnzipOptions{RestoreSymlinks: true})
+		},
+	} {
+		parent := t.TempDir()
+		dest := filepath.Join(parent, "a", "b")
+		assert.Nil(t, os.MkdirAll(dest, 0o755))
+		// a link already in the destination pointing out of it
+		if runtime.GOOS != "windows" {
+			assert.Nil(t, os.Symlink(parent, filepath.Join(dest, "out")))
+		}
+		assert.Nil(t, unzip(dest, fname), i)
+		b, err := os.ReadFile(filepath.Join(dest, "ok", "file.txt"))
+		assert.Nil(t, err)
+		assert.Equal(t, "root:x:0:0", string(b))
+		assertOnlyWrittenIn(t, parent, dest)
+	}
+
+	if runtime.GOOS != "windows" {
+		parent := t.TempDir()
+		dest := filepath.Join(parent, "a", "b")
+		assert.Nil(t, os.MkdirAll(dest, 0o755))
+		assert.Nil(t, os.Symlink(parent, filepath.Join(dest, "out")))
+		assert.NotNil(t, UnzipDirectoryVerified(dest, chainOnly))
+		assertOnlyWrittenIn(t, parent, dest)
+	}
+	assert.NotNil(t, UnzipDirectoryVerified(t.TempDir(), fname))
+
+	// extracting into the current directory keeps working
+	dest := t.TempDir()
+	t.Chdir(dest)
+	assert.Nil(t, UnzipDirectory(".", fname))
+	assert.True(t, Exists(filepath.Join("ok", "file.txt")))
+}
+
+func TestUnzipDirectoryVerified(t *testing.T) {
+	dir := t.TempDir()
+	content := []byte("some content that will be stored")
+	writeZip := func(fname string, crc uint32) {
+		f, err := os.Create(fname)
+		assert.Nil(t, err)
+		defer f.Close()
+		writer := zip.NewWriter(f)
+		w, err := writer.CreateRaw(&zip.FileHeader{
+			Name:               "dir/file.txt",
+			Method:             zip.Store,
+			CRC32:              crc,
+			CompressedSize64:   uint64(len(content)),
+			UncompressedSize64: uint64(len(content)),
+		})
+		assert.Nil(t, err)
+		w.Write(content)
+		assert.Nil(t, writer.Close())
+	}
+
+	good := filepath.Join(dir, "good.zip")
+	writeZip(good, crc32.ChecksumIEEE(content))
+	dest := filepath.Join(dir, "good")
+	assert.Nil(t, UnzipDirectoryVerified(dest, good))
+	b, err := os.ReadFile(filepath.Join(dest, "dir", "file.txt"))
+	assert.Nil(t, err)
+	assert.Equal(t, content, b)
+
+	corrupted := filepath.Join(dir, "corrupted.zip")
+	writeZip(corrupted, crc32.ChecksumIEEE(content)+1)
+	err = UnzipDirectoryVerified(filepath.Join(dir, "corrupted"), corrupted)
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "dir/file.txt")
+
+	assert.NotNil(t, UnzipDirectoryVerified(dest, filepath.Join(dir, "nofile.zip")))
+
+	// extracting into the current directory works too
+	t.Chdir(t.TempDir())
+	assert.Nil(t, UnzipDirectoryVerified(".", good))
+	b, err = os.ReadFile(filepath.Join("dir", "file.txt"))
+	assert.Nil(t, err)
+	assert.Equal(t, content, b)
+}
+
+func TestTransferSummary(t *testing.T) {
+	summary := TransferSummary{
+		FileCount:  3,
+		TotalBytes: 13002343,
+		Duration:   2 * time.Second,
+		Algorithm:  "xxhash",
+		Verified:   true,
+	}
+	assert.Equal(t, `Files: 3
+Size: 12.4 MB
+Duration: 2s
+Average rate: 6.2 MB/s
+Hash: xxhash (verified)`, summary.String())
+
+	summary = TransferSummary{FileCount: 1, TotalBytes: 50, Algorithm: "md5"}
+	s := summary.String()
+	assert.Contains(t, s, "Size: 50 B")
+	assert.Contains(t, s, "Average rate: -")
+	assert.Contains(t, s, "md5 (not verified)")
+}
+
+func TestNonConflictingName(t *testing.T) {
+	dir := t.TempDir()
+	name, err := NonConflictingName(dir, "file.txt")
+	assert.Nil(t, err)
+	assert.Equal(t, "file.txt", name)
+
+	for _, fname := range []string{"file.txt", "file (1).txt", "file (2).txt", "archive.tar.gz", ".bashrc", "noext"} {
+		assert.Nil(t, os.WriteFile(filepath.Join(dir, fname), []byte("x"), 0o644))
+	}
+	name, err = NonConflictingName(dir, "file.txt")
+	assert.Nil(t, err)
+	assert.Equal(t, "file (3).txt", name)
+	name, err = NonConflictingName(dir, "archive.tar.gz")
+	assert.Nil(t, err)
+	assert.Equal(t, "archive (1).tar.gz", name)
+	name, err = NonConflictingName(dir, ".bashrc")
+	assert.Nil(t, err)
+	assert.Equal(t, ".bashrc (1)", name)
+	name, err = NonConflictingName(dir, "noext")
+	assert.Nil(t, err)
+	assert.Equal(t, "noext (1)", name)
+
+	_, err = NonConflictingName(dir, "hi..txt")
+	assert.NotNil(t, err)
+}
+
+func TestPendingRanges(t *testing.T) {
+	fileSize := 95
+	chunkSize := 10
+	rand.Seed(1)
+	bigBuff := make([]byte, fileSize)
+	rand.Read(bigBuff)
+	fname := filepath.Join(t.TempDir(), "pending.test")
+	// the last chunk is partial and missing
+	copy(bigBuff[0:10], make([]byte, 10))
+	copy(bigBuff[40:60], make([]byte, 20))
+	copy(bigBuff[70:95], make([]byte, 25))
+	assert.Nil(t, os.WriteFile(fname, bigBuff, 0o644))
+
+	ranges, err := PendingRanges(fname, int64(fileSize), chunkSize)
+	assert.Nil(t, err)
+	assert.Equal(t, []ByteRange{{0, 10}, {40, 20}, {70, 25}}, ranges)
+	for i, r := range ranges {
+		assert.LessOrEqual(t, r.Start+r.Length, int64(fileSize))
+		if i > 0 {
+			assert.Greater(t, r.Start, ranges[i-1].Start+ranges[i-1].Length)
+		}
+	}
+
+	// nothing missing
+	rand.Read(bigBuff)
+	assert.Nil(t, os.WriteFile(fname, bigBuff, 0o644))
+	ranges, err = PendingRanges(fname, int64(fileSize), chunkSize)
+	assert.Nil(t, err)
+	assert.Empty(t, ranges)
+
+	// absent file
+	ranges, err = PendingRanges(fname+"nofile", int64(fileSize), chunkSize)
+	assert.Nil(t, err)
+	assert.Equal(t, []ByteRange{{0, int64(fileSize)}}, ranges)
+
+	_, err = PendingRanges(fname, int64(fileSize), 0)
+	assert.NotNil(t, err)
+}
+
+func TestCheckTempWritable(t *testing.T) {
+	assert.Nil(t, CheckTempWritable())
+
+	defer func(original func() []string) { tempDirs = original }(tempDirs)
+	// a regular file can't hold a probe file, even for root
+	notADir := filepath.Join(t.TempDir(), "file")
+	assert.Nil(t, os.WriteFile(notADir, []byte("x"), 0o644))
+	tempDirs = func() []string { return []string{os.TempDir(), notADir} }
+	err := CheckTempWritable()
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), notADir)
+	assert.Contains(t, err.Error(), "not writable")
+}
+
+func TestDirTransferID(t *testing.T) {
+	makeTree := func() string {
+		root := t.TempDir()
+		assert.Nil(t, os.MkdirAll(filepath.Join(root, "sub", "empty"), 0o755))
+		assert.Nil(t, os.WriteFile(filepath.Join(root, "a.txt"), []byte("hello"), 0o644))
+		assert.Nil(t, os.WriteFile(filepath.Join(root, "sub", "b.txt"), []byte("world"), 0o644))
+		return root
+	}
+	root := makeTree()
+	for _, algorithm := range []string{"xxhash", "imohash"} {
+		id, err := DirTransferID(root, algorithm)
+		assert.Nil(t, err)
+		again, err := DirTransferID(root, algorithm)
+		assert.Nil(t, err)
+		assert.Equal(t, id, again)
+		// an identical tree elsewhere has the same id
+		other, err := DirTransferID(makeTree(), algorithm)
+		assert.Nil(t, err)
+		assert.Equal(t, id, other)
+	}
+
+	id, err := DirTransferID(root, "xxhash")
+	assert.Nil(t, err)
+	// a single byte change alters the id
+	assert.Nil(t, os.WriteFile(filepath.Join(root, "sub", "b.txt"), []byte("worle"), 0o644))
+	changed, err := DirTransferID(root, "xxhash")
+	assert.Nil(t, err)
+	assert.NotEqual(t, id, changed)
+	// so does a structural change
+	assert.Nil(t, os.Mkdir(filepath.Join(root, "new"), 0o755))
+	structural, err := DirTransferID(root, "xxhash")
+	assert.Nil(t, err)
+	assert.NotEqual(t, changed, structural)
+
+	_, err = DirTransferID(filepath.Join(root, "nodir"), "xxhash")
+	assert.NotNil(t, err)
+}
+
+func TestUnzipDirectoryOverwriteAll(t *testing.T) {
+	assert.Nil(t, os.MkdirAll("overwritetest", 0o755))
+	defer os.RemoveAll("overwritetest")
+	names := []string{"a.txt", "b.txt", "c.txt"}
+	for _, name := range names {
+		assert.Nil(t, os.WriteFile(path.Join("overwritetest", name), []byte("new"), 0o644))
+	}
+	assert.Nil(t, ZipDirectory("overwritetest.zip", "overwritetest"))
+	defer os.Remove("overwritetest.zip")
+
+	defer func(original func(string) string) { getInput = original }(getInput)
+	for _, tc := range []struct {
+		answer   string
+		expected string
+	}{
+		{"a", "new"},
+		{"na", "old"},
+	} {
+		dest := t.TempDir()
+		assert.Nil(t, os.MkdirAll(path.Join(dest, "overwritetest"), 0o755))
+		for _, name := range names {
+			assert.Nil(t, os.WriteFile(path.Join(dest, "overwritetest", name), []byte("old"), 0o644))
+		}
+		prompts := 0
+		getInput = func(string) string {
+			prompts++
+			return tc.answer
+		}
+		assert.Nil(t, UnzipDirectory(dest, "overwritetest.zip"))
+		assert.Equal(t, 1, prompts, tc.answer)
+		for _, name := range names {
+			b, err := os.ReadFile(path.Join(dest, "overwritetest", name))
+			assert.Nil(t, err)
+			assert.Equal(t, tc.expected, string(b), tc.answer)
+		}
+	}
+}
+
+func TestUnzipDirectoryWithPolicy(t *testing.T) {
+	assert.Nil(t, os.MkdirAll("policytest", 0o755))
+	defer os.RemoveAll("policytest")
+	assert.Nil(t, os.WriteFile(path.Join("policytest", "a.txt"), []byte("new"), 0o644))
+	assert.Nil(t, ZipDirectory("policytest.zip", "policytest"))
+	defer os.Remove("policytest.zip")
+
+	defer func(original func(string) string) { getInput = original }(getInput)
+	getInput = func(string) string {
+		t.Fatal("prompted without the prompt policy")
+		return ""
+	}
+	for _, tc := range []struct {
+		policy   OverwritePolicy
+		expected string
+		fails    bool
+	}{
+		{OverwriteSkip, "old", false},
+		{OverwriteAlways, "new", false},
+		{OverwriteFail, "old", true},
+	} {
+		dest := t.TempDir()
+		assert.Nil(t, os.MkdirAll(path.Join(dest, "policytest"), 0o755))
+		assert.Nil(t, os.WriteFile(path.Join(dest, "policytest", "a.txt"), []byte("old"), 0o644))
+		err := UnzipDirectoryWithPolicy(dest, "policytest.zip", tc.policy)
+		assert.Equal(t, tc.fails, err != nil, tc.policy)
+		b, err := os.ReadFile(path.Join(dest, "policytest", "a.txt"))
+		assert.Nil(t, err)
+		assert.Equal(t, tc.expected, string(b), tc.policy)
+	}
+
+	// files that don't exist yet are extracted whatever the policy
+	dest := t.TempDir()
+	assert.Nil(t, UnzipDirectoryWithPolicy(dest, "policytest.zip", OverwriteFail))
+	assert.True(t, Exists(path.Join(dest, "policytest", "a.txt")))
+
+	assert.NotNil(t, UnzipDirectoryWithPolicy(dest, "policytest.zip", OverwritePolicy(42)))
+}
+
+func TestLargeFiles(t *testing.T) {
+	root := t.TempDir()
+	assert.Nil(t, os.MkdirAll(filepath.Join(root, "sub"), 0o755))
+	for i, fname := range []string{"a.txt", "b.txt", filepath.Join("sub", "c.txt")} {
+		assert.Nil(t, os.WriteFile(filepath.Join(root, fname), bytes.Repeat([]byte("x"), 10*(i+1)), 0o644))
+	}
+	big := filepath.Join(root, "sub", "big.bin")
+	assert.Nil(t, os.WriteFile(big, make([]byte, 5000), 0o644))
+
+	large, err := LargeFiles(root, 1000)
+	assert.Nil(t, err)
+	assert.Equal(t, []FileSize{{Path: big, Size: 5000}}, large)
+
+	large, err = LargeFiles(root, 5000)
+	assert.Nil(t, err)
+	assert.Empty(t, large)
+
+	_, err = LargeFiles(filepath.Join(root, "nodir"), 1000)
+	assert.NotNil(t, err)
+}
+
+func TestChunkVerifier(t *testing.T) {
+	chunkSize := 10
+	content := make([]byte, 95)
+	rand.Read(content)
+	fname := filepath.Join(t.TempDir(), "verify.test")
+	assert.Nil(t, os.WriteFile(fname, content, 0o644))
+	expected, err := ChunkHashes(fname, chunkSize)
+	assert.Nil(t, err)
+	assert.Len(t, expected, 10)
+
+	// good data in uneven writes
+	v := NewChunkVerifier(expected, chunkSize)
+	for i := 0; i < len(content); i += 7 {
+		n, err := v.Write(content[i:min(i+7, len(content))])
+		assert.Nil(t, err)
+		assert.Equal(t, min(7, len(content)-i), n)
+	}
+	assert.Nil(t, v.Close())
+
+	// the error fires exactly at the corrupted chunk
+	corrupted := append([]byte{}, content...)
+	corrupted[43] ^= 0xff
+	v = NewChunkVerifier(expected, chunkSize)
+	for i := 0; i < 4; i++ {
+		_, err = v.Write(corrupted[i*chunkSize : (i+1)*chunkSize])
+		assert.Nil(t, err)
+	}
+	_, err = v.Write(corrupted[40:50])
+	assert.NotNil(t, err)
+	assert.Equal(t, "chunk 4 is corrupt", err.Error())
+	_, err = v.Write(corrupted[50:60])
+	assert.NotNil(t, err)
+	assert.NotNil(t, v.Close())
+
+	// missing data is reported on Close
+	v = NewChunkVerifier(expected, chunkSize)
+	_, err = v.Write(content[:50])
+	assert.Nil(t, err)
+	assert.NotNil(t, v.Close())
+
+	// an invalid chunk size is reported rather than panicking
+	for _, size := range []int{0, -1} {
+		v = NewChunkVerifier(expected, size)
+		n, err := v.Write(content)
+		assert.Equal(t, 0, n)
+		assert.EqualError(t, err, fmt.Sprintf("invalid chunk size %d", size))
+		assert.NotNil(t, v.Close())
+	}
+}
+
+func TestExpandPath(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the home directory doesn't come from $HOME on windows")
+	}
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("CROC_TEST_DIR", "some dir")
+	wd, err := os.Getwd()
+	assert.Nil(t, err)
+	for _, tc := range []struct {
+		input    string
+		expected string
+	}{
+		{"~", home},
+		{"~/", home},
+		{"~/sub", filepath.Join(home, "sub")},
+		{"~/sub/../other/", filepath.Join(home, "other")},
+		{"$HOME/x", filepath.Join(home, "x")},
+		{"${HOME}/$CROC_TEST_DIR", filepath.Join(home, "some dir")},
+		{"/abs/path", "/abs/path"},
+		{"rel/path", filepath.Join(wd, "rel", "path")},
+		{"not~expanded", filepath.Join(wd, "not~expanded")},
+	} {
+		expanded, err := ExpandPath(tc.input)
+		assert.Nil(t, err, tc.input)
+		assert.Equal(t, tc.expected, expanded, tc.input)
+	}
+
+	if u, err := user.Current(); err == nil && u.HomeDir != "" {
+		expanded, err := ExpandPath("~" + u.Username + "/x")
+		assert.Nil(t, err)
+		assert.Equal(t, filepath.Join(u.HomeDir, "x"), expanded)
+	}
+	_, err = ExpandPath("~nosuchcrocuser/x")
+	assert.NotNil(t, err)
+
+	t.Setenv("HOME", "")
+	_, err = ExpandPath("~/x")
+	assert.NotNil(t, err)
+}
+
+func TestSameInode(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("hardlinks depend on the filesystem on windows")
+	}
+	dir := t.TempDir()
+	a := filepath.Join(dir, "a.txt")
+	assert.Nil(t, os.WriteFile(a, []byte("same"), 0o644))
+	link := filepath.Join(dir, "link.txt")
+	assert.Nil(t, os.Link(a, link))
+	copied := filepath.Join(dir, "copy.txt")
+	assert.Nil(t, os.WriteFile(copied, []byte("same"), 0o644))
+
+	same, err := SameInode(a, link)
+	assert.Nil(t, err)
+	assert.True(t, same)
+	same, err = SameInode(a, filepath.Join(dir, ".", "a.txt"))
+	assert.Nil(t, err)
+	assert.True(t, same)
+	same, err = SameInode(a, copied)
+	assert.Nil(t, err)
+	assert.False(t, same)
+	_, err = SameInode(a, filepath.Join(dir, "nofile"))
+	assert.NotNil(t, err)
+}
+
+func TestStreamChunkManifest(t *testing.T) {
+	content := make([]byte, 1000)
+	rand.Read(content)
+	fname := filepath.Join(t.TempDir(), "manifest.test")
+	assert.Nil(t, os.WriteFile(fname, content, 0o644))
+
+	chunks, rollup, err := StreamChunkManifest(bytes.NewReader(content), 64, "md5")
+	assert.Nil(t, err)
+	assert.Len(t, chunks, 16)
+	assert.Equal(t, int64(15*64), chunks[15].Offset)
+	assert.Equal(t, int64(1000-15*64), chunks[15].Length)
+
+	// same digests as a file based computation
+	var concatenated []byte
+	i := 0
+	err = ProcessFileChunks(fname, 64, func(offset int64, chunk []byte) error {
+		sum := md5.Sum(chunk)
+		assert.Equal(t, sum[:], chunks[i].Hash)
+		assert.Equal(t, offset, chunks[i].Offset)
+		concatenated = append(concatenated, sum[:]...)
+		i++
+		return nil
+	})
+	assert.Nil(t, err)
+	expected := md5.Sum(concatenated)
+	assert.Equal(t, expected[:], rollup)
+
+	chunks, _, err = StreamChunkManifest(bytes.NewReader(nil), 64, "xxhash")
+	assert.Nil(t, err)
+	assert.Empty(t, chunks)
+	_, _, err = StreamChunkManifest(bytes.NewReader(content), 64, "imohash")
+	assert.NotNil(t, err)
+	_, _, err = StreamChunkManifest(bytes.NewReader(content), 0, "md5")
+	assert.NotNil(t, err)
+}
+
+func TestStripBOM(t *testing.T) {
+	dir := t.TempDir()
+	content := []byte("#!/bin/sh\necho hello\n")
+	withBOM := filepath.Join(dir, "bom.sh")
+	assert.Nil(t, os.WriteFile(withBOM, append([]byte{0xef, 0xbb, 0xbf}, content...), 0o644))
+	stripped, err := StripBOM(withBOM)
+	assert.Nil(t, err)
+	assert.True(t, stripped)
+	b, err := os.ReadFile(withBOM)
+	assert.Nil(t, err)
+	assert.Equal(t, content, b)
+
+	utf16 := filepath.Join(dir, "utf16.txt")
+	assert.Nil(t, os.WriteFile(utf16, []byte{0xff, 0xfe, 'h', 0, 'i', 0}, 0o644))
+	stripped, err = StripBOM(utf16)
+	assert.Nil(t, err)
+	assert.True(t, stripped)
+	b, err = os.ReadFile(utf16)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte{'h', 0, 'i', 0}, b)
+
+	noBOM := filepath.Join(dir, "plain.sh")
+	assert.Nil(t, os.WriteFile(noBOM, content, 0o644))
+	before, err := os.Stat(noBOM)
+	assert.Nil(t, err)
+	stripped, err = StripBOM(noBOM)
+	assert.Nil(t, err)
+	assert.False(t, stripped)
+	after, err := os.Stat(noBOM)
+	assert.Nil(t, err)
+	assert.True(t, os.SameFile(before, after))
+	b, err = os.ReadFile(noBOM)
+	assert.Nil(t, err)
+	assert.Equal(t, content, b)
+
+	// shorter than the longest BOM
+	for _, short := range [][]byte{{}, {0xef}, {0xfe, 0xff}} {
+		fname := filepath.Join(dir, "short.txt")
+		assert.Nil(t, os.WriteFile(fname, short, 0o644))
+		stripped, err = StripBOM(fname)
+		assert.Nil(t, err)
+		assert.Equal(t, len(short) == 2, stripped)
+		b, err = os.ReadFile(fname)
+		assert.Nil(t, err)
+		if stripped {
+			assert.Empty(t, b)
+		} else {
+			assert.Equal(t, short, b)
+		}
+	}
+
+	_, err = StripBOM(filepath.Join(dir, "nofile"))
+	assert.NotNil(t, err)
+}
+
+func TestSanitizePath(t *testing.T) {
+	assert.Equal(t, "dir/file.txt", SanitizePath("dir/file.txt"))
+	assert.Equal(t, "dir/what_.txt", SanitizePath("./dir//what?.txt"))
+	assert.Equal(t, "etc/passwd", SanitizePath("../../etc/passwd"))
+	assert.Equal(t, "_CON/_aux.txt/trailing", SanitizePath("CON/aux.txt/trailing. "))
+	assert.Equal(t, "a_b/_", SanitizePath("a\tb/..."))
+}
+
+func TestArchiveMemberName(t *testing.T) {
+	base := filepath.Join(t.TempDir(), "base")
+	name, err := ArchiveMemberName(filepath.Join(base, "sub", "file.txt"), base)
+	assert.Nil(t, err)
+	assert.Equal(t, "sub/file.txt", name)
+
+	name, err = ArchiveMemberName(filepath.Join(base, "sub", "a<b>", "nul.txt"), base)
+	assert.Nil(t, err)
+	assert.Equal(t, "sub/a_b_/_nul.txt", name)
+
+	_, err = ArchiveMemberName(filepath.Join(base, "..", "outside.txt"), base)
+	assert.NotNil(t, err)
+	_, err = ArchiveMemberName(base+"2", base)
+	assert.NotNil(t, err)
+	_, err = ArchiveMemberName(base, base)
+	assert.NotNil(t, err)
+}
+
+func TestParseChecksumManifest(t *testing.T) {
+	dir := t.TempDir()
+	manifest := filepath.Join(dir, "SHA256SUMS")
+	assert.Nil(t, os.WriteFile(manifest, []byte(`# checksums of the release
+09ca7e4eaa6e8ae9c7d261167129184883644d07dfba7cbfbc4c8a2e08360d5b  croc_v10.0.0_Linux-64bit.tar.gz
+E3B0C44298FC1C149AFBF4C8996FB92427AE41E4649B934CA495991B7852B855 *croc_v10.0.0_Windows-64bit.zip
+
+a591a6d40bf420404a011733cfb7b190d62c65bf0bcda32b57b277d9ad9f146e  name with  spaces.txt`+"\r\n"), 0o644))
+	digests, err := ParseChecksumManifest(manifest)
+	assert.Nil(t, err)
+	assert.Len(t, digests, 3)
+	assert.Equal(t, "09ca7e4eaa6e8ae9c7d261167129184883644d07dfba7cbfbc4c8a2e08360d5b", fmt.Sprintf("%x", digests["croc_v10.0.0_Linux-64bit.tar.gz"]))
+	assert.Equal(t, "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855", fmt.Sprintf("%x", digests["croc_v10.0.0_Windows-64bit.zip"]))
+	assert.Contains(t, digests, "name with  spaces.txt")
+
+	for _, malformed := range []string{
+		"zz  file.txt\n",
+		"09ca7e4eaa6e8ae9c7d261167129184883644d07dfba7cbfbc4c8a2e08360d5b\n",
+		"09ca7e4eaa6e8ae9c7d261167129184883644d07dfba7cbfbc4c8a2e08360d5b file.txt\n",
+		"09ca7e4  ok.txt\n",
+	} {
+		assert.Nil(t, os.WriteFile(manifest, []byte(malformed), 0o644))
+		_, err = ParseChecksumManifest(manifest)
+		assert.NotNil(t, err, malformed)
+	}
+
+	_, err = ParseChecksumManifest(filepath.Join(dir, "nofile"))
+	assert.NotNil(t, err)
+}
+
+func TestOrderFiles(t *testing.T) {
+	dir := t.TempDir()
+	var files []string
+	for _, f := range []struct {
+		name string
+		size int
+	}{{"b.txt", 300}, {"a.txt", 20}, {"d.txt", 1000}, {"c.txt", 20}} {
+		fname := filepath.Join(dir, f.name)
+		assert.Nil(t, os.WriteFile(fname, make([]byte, f.size), 0o644))
+		files = append(files, fname)
+	}
+	names := func(ordered []string) (result []string) {
+		for _, fname := range ordered {
+			result = append(result, filepath.Base(fname))
+		}
+		return
+	}
+
+	ordered, err := OrderFiles(files, SmallestFirst)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"a.txt", "c.txt", "b.txt", "d.txt"}, names(ordered))
+	ordered, err = OrderFiles(files, LargestFirst)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"d.txt", "b.txt", "a.txt", "c.txt"}, names(ordered))
+	ordered, err = OrderFiles(files, Alphabetical)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"a.txt", "b.txt", "c.txt", "d.txt"}, names(ordered))
+	assert.Equal(t, "b.txt", filepath.Base(files[0]))
+
+	_, err = OrderFiles(files, OrderStrategy(42))
+	assert.NotNil(t, err)
+	_, err = OrderFiles(append(files, filepath.Join(dir, "nofile")), SmallestFirst)
+	assert.NotNil(t, err)
+}
+
+func TestValidatePresentChunks(t *testing.T) {
+	fileSize := 95
+	chunkSize := 10
+	content := make([]byte, fileSize)
+	rand.Read(content)
+	fname := filepath.Join(t.TempDir(), "present.test")
+	assert.Nil(t, os.WriteFile(fname, content, 0o644))
+	expected, err := ChunkHashes(fname, chunkSize)
+	assert.Nil(t, err)
+
+	// chunks 2 and 9 are missing, chunk 6 is corrupt
+	partial := append([]byte{}, content...)
+	copy(partial[20:30], make([]byte, 10))
+	copy(partial[90:], make([]byte, 5))
+	partial[63] ^= 0xff
+	assert.Nil(t, os.WriteFile(fname, partial, 0o644))
+	corrupt, err := ValidatePresentChunks(fname, int64(fileSize), chunkSize, expected)
+	assert.Nil(t, err)
+	assert.Equal(t, []int64{6}, corrupt)
+
+	partial[63] ^= 0xff
+	assert.Nil(t, os.WriteFile(fname, partial, 0o644))
+	corrupt, err = ValidatePresentChunks(fname, int64(fileSize), chunkSize, expected)
+	assert.Nil(t, err)
+	assert.Empty(t, corrupt)
+
+	_, err = ValidatePresentChunks(fname, int64(fileSize+1), chunkSize, expected)
+	assert.NotNil(t, err)
+	_, err = ValidatePresentChunks(fname, int64(fileSize), chunkSize, expected[1:])
+	assert.NotNil(t, err)
+}
+
+func TestTransferToken(t *testing.T) {
+	for _, token := range []TransferToken{
+		{Code: "1234-apple-river-stone", Relay: "croc.schollz.com:9009", Expires: time.Unix(1893456000, 0)},
+		{Code: "mysecret"},
+	} {
+		encoded, err := EncodeTransferToken(token)
+		assert.Nil(t, err)
+		assert.NotContains(t, encoded, "=")
+		assert.NotContains(t, encoded, "+")
+		assert.NotContains(t, encoded, "/")
+		decoded, err := DecodeTransferToken(encoded)
+		assert.Nil(t, err)
+		assert.Equal(t, token.Code, decoded.Code)
+		assert.Equal(t, token.Relay, decoded.Relay)
+		assert.True(t, token.Expires.Equal(decoded.Expires))
+	}
+
+	_, err := EncodeTransferToken(TransferToken{Relay: "croc.schollz.com:9009"})
+	assert.NotNil(t, err)
+	_, err = EncodeTransferToken(TransferToken{Code: strings.Repeat("a", 256)})
+	assert.NotNil(t, err)
+
+	encoded, err := EncodeTransferToken(TransferToken{Code: "1234-apple-river-stone"})
+	assert.Nil(t, err)
+	for _, malformed := range []string{
+		"",
+		"!!!",
+		encoded[:len(encoded)-3],
+		encoded + "AA",
+		base64.RawURLEncoding.EncodeToString([]byte{2, 1, 'a', 0, 0, 0, 0, 0, 0, 0, 0, 0}),
+		base64.RawURLEncoding.EncodeToString([]byte{1, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}),
+		base64.RawURLEncoding.EncodeToString([]byte{1, 200, 'a'}),
+	} {
+		_, err = DecodeTransferToken(malformed)
+		assert.NotNil(t, err, malformed)
+	}
+}
+
+func TestHasIPv6Connectivity(t *testing.T) {
+	defer func(original func(context.Context, string, string) (net.Conn, error)) { ipv6Dial = original }(ipv6Dial)
+	resetCache := func() {
+		ipv6Connectivity.Lock()
+		ipv6Connectivity.checked = time.Time{}
+		ipv6Connectivity.Unlock()
+	}
+	defer resetCache()
+
+	dials := 0
+	ipv6Dial = func(ctx context.Context, network, address string) (net.Conn, error) {
+		dials++
+		assert.Equal(t, "tcp6", network)
+		client, server := net.Pipe()
+		server.Close()
+		return client, nil
+	}
+	resetCache()
+	assert.True(t, HasIPv6Connectivity(context.Background()))
+	assert.True(t, HasIPv6Connectivity(context.Background()))
+	assert.Equal(t, 1, dials)
+
+	dials = 0
+	ipv6Dial = func(ctx context.Context, network, address string) (net.Conn, error) {
+		dials++
+		return nil, fmt.Errorf("connect: network is unreachable")
+	}
+	resetCache()
+	assert.False(t, HasIPv6Connectivity(context.Background()))
+	assert.False(t, HasIPv6Connectivity(context.Background()))
+	assert.Equal(t, 1, dials)
+
+	// a cancelled probe is not cached
+	dials = 0
+	resetCache()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.False(t, HasIPv6Connectivity(ctx))
+	assert.False(t, HasIPv6Connectivity(ctx))
+	assert.Equal(t, 2, dials)
+}
+
+func TestUpdateConfig(t *testing.T) {
+	t.Setenv("CROC_CONFIG_DIR", t.TempDir())
+	c, err := LoadConfig()
+	assert.Nil(t, err)
+	assert.Equal(t, &Config{}, c)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.Nil(t, UpdateConfig(func(c *Config) error {
+				c.TransferCount++
+				return nil
+			}))
+		}()
+	}
+	wg.Wait()
+	c, err = LoadConfig()
+	assert.Nil(t, err)
+	assert.Equal(t, 20, c.TransferCount)
+
+	// nothing is saved when fn fails
+	errUpdate := fmt.Errorf("update failed")
+	assert.Equal(t, errUpdate, UpdateConfig(func(c *Config) error {
+		c.RelayAddress = "example.com:9009"
+		return errUpdate
+	}))
+	c, err = LoadConfig()
+	assert.Nil(t, err)
+	assert.Empty(t, c.RelayAddress)
+}
+
+func TestMissingByteRanges(t *testing.T) {
+	fileSize := 95
+	chunkSize := 10
+	bigBuff := make([]byte, fileSize)
+	rand.Read(bigBuff)
+	fname := filepath.Join(t.TempDir(), "ranges.test")
+	// adjacent missing chunks are coalesced
+	copy(bigBuff[10:30], make([]byte, 20))
+	copy(bigBuff[50:60], make([]byte, 10))
+	copy(bigBuff[90:95], make([]byte, 5))
+	assert.Nil(t, os.WriteFile(fname, bigBuff, 0o644))
+
+	headers, err := MissingByteRanges(fname, int64(fileSize), chunkSize)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"bytes=10-29", "bytes=50-59", "bytes=90-94"}, headers)
+
+	headers, err = MissingByteRanges(filepath.Join(t.TempDir(), "absent"), int64(fileSize), chunkSize)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"bytes=0-94"}, headers)
+}
+
+func TestIsFileStable(t *testing.T) {
+	fname := filepath.Join(t.TempDir(), "stable.test")
+	assert.Nil(t, os.WriteFile(fname, []byte("hello"), 0o644))
+	stable, err := IsFileStable(fname, 50*time.Millisecond)
+	assert.Nil(t, err)
+	assert.True(t, stable)
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		f, err := os.OpenFile(fname, os.O_APPEND|os.O_WRONLY, 0o644)
+		if err != nil {
+			return
+		}
+		defer f.Close()
+		for {
+			select {
+			case <-done:
+				return
+			case <-time.After(5 * time.Millisecond):
+				f.Write([]byte("more"))
+			}
+		}
+	}()
+	stable, err = IsFileStable(fname, 50*time.Millisecond)
+	close(done)
+	wg.Wait()
+	assert.Nil(t, err)
+	assert.False(t, stable)
+
+	_, err = IsFileStable(filepath.Join(t.TempDir(), "absent"), time.Millisecond)
+	assert.NotNil(t, err)
+}
+
+type countingReporter struct {
+	total int
+}
+
+func (r *countingReporter) Add(n int) error {
+	r.total += n
+	return nil
+}
+
+func TestHashFileOpts(t *testing.T) {
+	content := make([]byte, 3*1024*1024+17)
+	rand.Read(content)
+	fname := filepath.Join(t.TempDir(), "opts.test")
+	assert.Nil(t, os.WriteFile(fname, content, 0o644))
+	plain, err := HashFile(fname, "md5")
+	assert.Nil(t, err)
+	assert.Equal(t, md5.Sum(content), [16]byte(plain))
+
+	// cancellation
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = HashFileOpts(fname, HashOptions{Algorithm: "md5", Context: ctx})
+	assert.ErrorIs(t, err, context.Canceled)
+	_, err = HashFileOpts(fname, HashOptions{Algorithm: "xxhash", Context: &cancelAfter{Context: context.Background(), n: 2}})
+	assert.ErrorIs(t, err, context.Canceled)
+
+	// progress
+	reporter := &countingReporter{}
+	b, err := HashFileOpts(fname, HashOptions{Algorithm: "md5", Progress: reporter})
+	assert.Nil(t, err)
+	assert.Equal(t, plain, b)
+	assert.Equal(t, len(content), reporter.total)
+
+	// salt
+	b, err = HashFileOpts(fname, HashOptions{Algorithm: "md5", Salt: []byte("salt")})
+	assert.Nil(t, err)
+	assert.Equal(t, md5.Sum(append([]byte("salt"), content...)), [16]byte(b))
+	_, err = HashFileOpts(fname, HashOptions{Algorithm: "imohash", Salt: []byte("salt")})
+	assert.NotNil(t, err)
+
+	// mmap gives the same result, also when it has to fall back
+	for _, algorithm := range []string{"md5", "xxhash", "highway"} {
+		expected, err := HashFile(fname, algorithm)
+		assert.Nil(t, err)
+		b, err = HashFileOpts(fname, HashOptions{Algorithm: algorithm, Mmap: true})
+		assert.Nil(t, err)
+		assert.Equal(t, expected, b)
+	}
+	empty := filepath.Join(t.TempDir(), "empty.test")
+	assert.Nil(t, os.WriteFile(empty, nil, 0o644))
+	b, err = HashFileOpts(empty, HashOptions{Algorithm: "md5", Mmap: true})
+	assert.Nil(t, err)
+	assert.Equal(t, md5.Sum(nil), [16]byte(b))
+
+	_, err = HashFileOpts(fname, HashOptions{Algorithm: "nope"})
+	assert.NotNil(t, err)
+}
+
+// truncatingReporter truncates fname once the first block has been hashed
+type truncatingReporter struct {
+	fname string
+}
+
+func (r truncatingReporter) Add(n int) error {
+	return os.Truncate(r.fname, 0)
+}
+
+func TestHashFileOptsMmapTruncated(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("mmap is not supported on windows")
+	}
+	fname := filepath.Join(t.TempDir(), "truncated.test")
+	assert.Nil(t, os.WriteFile(fname, make([]byte, 4*1024*1024), 0o644))
+	_, err := HashFileOpts(fname, HashOptions{Algorithm: "xxhash", Mmap: true, Progress: truncatingReporter{fname}})
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "changed while being hashed")
+}
+
+func TestSecureConfigDir(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("file modes are not enforced on windows")
+	}
+	configDir := filepath.Join(t.TempDir(), "croc")
+	assert.Nil(t, os.Mkdir(configDir, 0o755))
+	assert.Nil(t, os.Chmod(configDir, 0o755))
+	fname := filepath.Join(configDir, "send.json")
+	assert.Nil(t, os.WriteFile(fname, []byte("{}"), 0o644))
+	assert.Nil(t, os.Chmod(fname, 0o644))
+	private := filepath.Join(configDir, "private.json")
+	assert.Nil(t, os.WriteFile(private, []byte("{}"), 0o400))
+	readOnly := filepath.Join(configDir, "readonly.json")
+	assert.Nil(t, os.WriteFile(readOnly, []byte("{}"), 0o440))
+	assert.Nil(t, os.Chmod(readOnly, 0o440))
+	readOnlyDir := filepath.Join(configDir, "readonly")
+	assert.Nil(t, os.Mkdir(readOnlyDir, 0o755))
+	assert.Nil(t, os.Chmod(readOnlyDir, 0o555))
+	defer os.Chmod(readOnlyDir, 0o755)
+	t.Setenv("CROC_CONFIG_DIR", configDir)
+
+	assert.Nil(t, SecureConfigDir())
+	stat, err := os.Stat(configDir)
+	assert.Nil(t, err)
+	assert.Equal(t, os.FileMode(0o700), stat.Mode().Perm())
+	stat, err = os.Stat(fname)
+	assert.Nil(t, err)
+	assert.Equal(t, os.FileMode(0o600), stat.Mode().Perm())
+	// stricter modes are kept
+	stat, err = os.Stat(private)
+	assert.Nil(t, err)
+	assert.Equal(t, os.FileMode(0o400), stat.Mode().Perm())
+	// only the permissions of others are removed, none are added
+	stat, err = os.Stat(readOnly)
+	assert.Nil(t, err)
+	assert.Equal(t, os.FileMode(0o400), stat.Mode().Perm())
+	stat, err = os.Stat(readOnlyDir)
+	assert.Nil(t, err)
+	assert.Equal(t, os.FileMode(0o500), stat.Mode().Perm())
+}
+
+func TestBlockAlignedChunkSize(t *testing.T) {
+	dir := t.TempDir()
+	for _, desired := range []int{1, 1000, 4096, 100000, 1024 * 1024} {
+		chunkSize, err := BlockAlignedChunkSize(dir, desired)
+		assert.Nil(t, err)
+		assert.GreaterOrEqual(t, chunkSize, desired)
+		if runtime.GOOS != "windows" {
+			// block sizes are a power of two of at least 512 bytes
+			assert.Zero(t, chunkSize%512)
+		}
+	}
+	chunkSize, err := BlockAlignedChunkSize(filepath.Join(dir, "not yet received"), 1000)
+	assert.Nil(t, err)
+	assert.GreaterOrEqual(t, chunkSize, 1000)
+
+	_, err = BlockAlignedChunkSize(dir, 0)
+	assert.NotNil(t, err)
+}
+
+func TestFindBasenameCollisions(t *testing.T) {
+	dir := t.TempDir()
+	first := filepath.Join(dir, "first", "a.txt")
+	second := filepath.Join(dir, "second", "a.txt")
+	unique := filepath.Join(dir, "first", "b.txt")
+	collisions, err := FindBasenameCollisions([]string{first, second, unique, first})
+	assert.Nil(t, err)
+	assert.Equal(t, map[string][]string{"a.txt": {first, second}}, collisions)
+
+	collisions, err = FindBasenameCollisions([]string{first, unique})
+	assert.Nil(t, err)
+	assert.Empty(t, collisions)
+}
+
+func TestVerifyAndUnzip(t *testing.T) {
+	assert.Nil(t, os.MkdirAll("verifytest", 0o755))
+	defer os.RemoveAll("verifytest")
+	assert.Nil(t, os.WriteFile(path.Join("verifytest", "a.txt"), []byte("hello"), 0o644))
+	defer os.Remove("verifytest.zip")
+	assert.Nil(t, ZipDirectory("verifytest.zip", "verifytest"))
+	expected, err := HashFile("verifytest.zip", "xxhash")
+	assert.Nil(t, err)
+
+	dest := t.TempDir()
+	tampered := append([]byte{}, expected...)
+	tampered[0] ^= 0xff
+	assert.ErrorIs(t, VerifyAndUnzip(dest, "verifytest.zip", "xxhash", tampered), ErrHashMismatch)
+	entries, err := os.ReadDir(dest)
+	assert.Nil(t, err)
+	assert.Empty(t, entries)
+
+	// sampling or broken algorithms are refused even with a matching hash
+	for _, algorithm := range []string{"imohash", "md5", "sha1"} {
+		hash, err := HashFile("verifytest.zip", algorithm)
+		assert.Nil(t, err)
+		err = VerifyAndUnzip(dest, "verifytest.zip", algorithm, hash)
+		assert.NotNil(t, err)
+		assert.NotErrorIs(t, err, ErrHashMismatch)
+	}
+	entries, err = os.ReadDir(dest)
+	assert.Nil(t, err)
+	assert.Empty(t, entries)
+
+	assert.Nil(t, VerifyAndUnzip(dest, "verifytest.zip", "xxhash", expected))
+	b, err := os.ReadFile(path.Join(dest, "verifytest", "a.txt"))
+	assert.Nil(t, err)
+	assert.Equal(t, "hello", string(b))
+}
+
+func TestResumeState(t *testing.T) {
+	t.Setenv("CROC_CACHE_DIR", t.TempDir())
+	_, err := LoadResumeState("1234-some-code")
+	assert.True(t, os.IsNotExist(err))
+
+	state := &ResumeState{
+		TotalSize: 95,
+		ChunkSize: 10,
+		Bitset:    []byte{0b10110101, 0b10},
+		Hash:      []byte{1, 2, 3},
+	}
+	assert.Nil(t, state.Save("1234-some-code"))
+	// the code is normalized
+	loaded, err := LoadResumeState("1234 SOME code")
+	assert.Nil(t, err)
+	assert.Equal(t, state, loaded)
+	assert.Nil(t, loaded.Validate(95, 10))
+
+	// a different file means starting over
+	assert.NotNil(t, loaded.Validate(96, 10))
+	assert.NotNil(t, loaded.Validate(95, 20))
+
+	_, err = LoadResumeState("5678-other-code")
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestFormatDuration(t *testing.T) {
+	tests := []struct {
+		d        time.Duration
+		expected string
+	}{
+		{0, "0ms"},
+		{850 * time.Millisecond, "850ms"},
+		{time.Second, "1s"},
+		{45*time.Second + 300*time.Millisecond, "45s"},
+		{2 * time.Minute, "2m"},
+		{65 * time.Second, "1m5s"},
+		{time.Hour + 2*time.Minute + 3*time.Second, "1h2m"},
+		{time.Hour + 3*time.Second, "1h"},
+		{30 * time.Hour, "30h"},
+		{-2 * time.Minute, "-2m"},
+		{-850 * time.Millisecond, "-850ms"},
+		{math.MinInt64, "-2562047h47m"},
+		{math.MaxInt64, "2562047h47m"},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.expected, FormatDuration(tt.d), tt.d.String())
+	}
+}
+
+func TestHashDirectoryParallel(t *testing.T) {
+	root := t.TempDir()
+	for i := 0; i < 200; i++ {
+		dir := filepath.Join(root, fmt.Sprintf("dir%d", i%7))
+		assert.Nil(t, os.MkdirAll(dir, 0o755))
+		assert.Nil(t, os.WriteFile(filepath.Join(dir, fmt.Sprintf("file%d.txt", i)), []byte(fmt.Sprintf("content %d", i)), 0o644))
+	}
+	expected, err := HashDirectory(root, "xxhash")
+	assert.Nil(t, err)
+	assert.Len(t, expected, 200)
+
+	// many more workers than files allowed to be open at once
+	SetMaxOpenFiles(2)
+	defer SetMaxOpenFiles(0)
+	hashes, err := HashDirectoryParallel(root, "xxhash", 64)
+	assert.Nil(t, err)
+	assert.Equal(t, expected, hashes)
+
+	hashes, err = HashDirectoryParallel(root, "xxhash", 0)
+	assert.Nil(t, err)
+	assert.Equal(t, expected, hashes)
+
+	_, err = HashDirectoryParallel(root, "nope", 4)
+	assert.NotNil(t, err)
+}
+
+func TestShouldSkipReceive(t *testing.T) {
+	dir := t.TempDir()
+	fname := filepath.Join(dir, "received.txt")
+	sum := md5.Sum([]byte("hello"))
+	expected := sum[:]
+
+	skip, err := ShouldSkipReceive(fname, expected, "md5")
+	assert.Nil(t, err)
+	assert.False(t, skip)
+
+	assert.Nil(t, os.WriteFile(fname, []byte("hello"), 0o644))
+	skip, err = ShouldSkipReceive(fname, expected, "md5")
+	assert.Nil(t, err)
+	assert.True(t, skip)
+
+	assert.Nil(t, os.WriteFile(fname, []byte("hello, world"), 0o644))
+	skip, err = ShouldSkipReceive(fname, expected, "md5")
+	assert.Nil(t, err)
+	assert.False(t, skip)
+
+	skip, err = ShouldSkipReceive(dir, expected, "md5")
+	assert.Nil(t, err)
+	assert.False(t, skip)
+}
+
+func TestHashReader(t *testing.T) {
+	bigFile()
+	defer os.Remove("bigfile.test")
+	for _, algorithm := range []string{"md5", "xxhash", "highway"} {
+		expected, err := HashFile("bigfile.test", algorithm)
+		assert.Nil(t, err)
+		f, err := os.Open("bigfile.test")
+		assert.Nil(t, err)
+		b, err := HashReader(f, algorithm)
+		f.Close()
+		assert.Nil(t, err)
+		assert.Equal(t, expected, b)
+	}
+	_, err := HashReader(strings.NewReader("hello"), "imohash")
+	assert.NotNil(t, err)
+}
+
+func TestGetLocalIPsSorted(t *testing.T) {
+	defer func() { interfaceAddresses = net.InterfaceAddrs }()
+	interfaceAddresses = func() ([]net.Addr, error) {
+		var addrs []net.Addr
+		for _, ip := range []string{"203.0.113.9", "192.168.1.20", "127.0.0.1", "10.0.0.5", "100.64.0.1", "192.168.1.3", "fe80::1", "172.16.4.4"} {
+			addrs = append(addrs, &net.IPNet{IP: net.ParseIP(ip), Mask: net.CIDRMask(24, 32)})
+		}
+		return addrs, nil
+	}
+	ips, err := GetLocalIPsSorted()
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"10.0.0.5", "172.16.4.4", "192.168.1.3", "192.168.1.20", "100.64.0.1", "203.0.113.9"}, ips)
+
+	interfaceAddresses = func() ([]net.Addr, error) {
+		return nil, fmt.Errorf("no interfaces")
+	}
+	_, err = GetLocalIPsSorted()
+	assert.NotNil(t, err)
+}
+
+func TestLANInterfaces(t *testing.T) {
+	ipnet := func(s string) net.Addr {
+		ip, network, err := net.ParseCIDR(s)
+		assert.Nil(t, err)
+		network.IP = ip
+		return network
+	}
+	defer func(f func() ([]interfaceAddrs, error)) { listInterfaces = f }(listInterfaces)
+	listInterfaces = func() ([]interfaceAddrs, error) {
+		return []interfaceAddrs{
+			{net.Interface{Name: "lo", Flags: net.FlagUp | net.FlagLoopback}, []net.Addr{ipnet("127.0.0.1/8"), ipnet("::1/128")}},
+			{net.Interface{Name: "eth0", Flags: net.FlagUp}, []net.Addr{ipnet("192.168.1.5/24"), ipnet("fe80::1/64"), ipnet("2001:db8::5/64")}},
+			{net.Interface{Name: "eth1"}, []net.Addr{ipnet("10.0.0.2/8")}},
+			{net.Interface{Name: "wan0", Flags: net.FlagUp}, []net.Addr{ipnet("203.0.113.7/24")}},
+		}, nil
+	}
+	ifaces, err := LANInterfaces()
+	assert.Nil(t, err)
+	assert.Equal(t, []LANInterface{
+		{Name: "eth0", Addresses: []LANAddress{
+			{IP: net.ParseIP("192.168.1.5"), Private: true},
+			{IP: net.ParseIP("2001:db8::5"), Private: false},
+		}},
+		{Name: "wan0", Addresses: []LANAddress{
+			{IP: net.ParseIP("203.0.113.7"), Private: false},
+		}},
+	}, ifaces)
+
+	assert.True(t, IsPrivateIP(net.ParseIP("10.1.2.3")))
+	assert.True(t, IsPrivateIP(net.ParseIP("172.16.0.1")))
+	assert.True(t, IsPrivateIP(net.ParseIP("fd00::1")))
+	assert.False(t, IsPrivateIP(net.ParseIP("8.8.8.8")))
+}
+
+func TestHashFileContext(t *testing.T) {
+	bigFile()
+	defer os.Remove("bigfile.test")
+	expected, err := HashFile("bigfile.test", "md5")
+	assert.Nil(t, err)
+	b, err := HashFileContext(context.Background(), "bigfile.test", "md5", false)
+	assert.Nil(t, err)
+	assert.Equal(t, expected, b)
+
+	// cancelled in the middle of the file
+	_, err = HashFileContext(&cancelAfter{Context: context.Background(), n: 3}, "bigfile.test", "highway", false)
+	assert.ErrorIs(t, err, context.Canceled)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = HashFileContext(ctx, "bigfile.test", "imohash", false)
+	assert.ErrorIs(t, err, context.Canceled)
+}
+
+func TestTimeBucketedCode(t *testing.T) {
+	secret := []byte("shared secret")
+	bucket := 10 * time.Minute
+	start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	codeAt := func(secret []byte, at time.Time) string {
+		code, err := TimeBucketedCode(secret, bucket, at)
+		assert.Nil(t, err)
+		return code
+	}
+
+	code := codeAt(secret, start)
+	assert.Regexp(t, `^\d{4}-[a-z]+-[a-z]+-[a-z]+$`, code)
+	// the other end, later within the same bucket
+	assert.Equal(t, code, codeAt(secret, start.Add(9*time.Minute)))
+	assert.NotEqual(t, code, codeAt(secret, start.Add(10*time.Minute)))
+	assert.NotEqual(t, code, codeAt([]byte("other secret"), start))
+
+	current, previous, err := TimeBucketedCodes(secret, bucket, start.Add(12*time.Minute))
+	assert.Nil(t, err)
+	assert.Equal(t, code, previous)
+	assert.Equal(t, codeAt(secret, start.Add(10*time.Minute)), current)
+
+	for _, bucket := range []time.Duration{0, -time.Minute} {
+		_, err = TimeBucketedCode(secret, bucket, start)
+		assert.NotNil(t, err)
+		_, _, err = TimeBucketedCodes(secret, bucket, start)
+		assert.NotNil(t, err)
+	}
+}
+
+func TestCheckWritableDir(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "not", "yet", "created")
+	assert.Nil(t, CheckWritableDir(dir))
+	entries, err := os.ReadDir(dir)
+	assert.Nil(t, err)
+	assert.Empty(t, entries)
+
+	notADir := filepath.Join(t.TempDir(), "file")
+	assert.Nil(t, os.WriteFile(notADir, []byte("x"), 0o644))
+	err = CheckWritableDir(notADir)
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), notADir)
+
+	if runtime.GOOS == "windows" || os.Geteuid() == 0 {
+		t.Skip("directory modes don't restrict this user")
+	}
+	readOnly := t.TempDir()
+	assert.Nil(t, os.Chmod(readOnly, 0o555))
+	defer os.Chmod(readOnly, 0o755)
+	err = CheckWritableDir(readOnly)
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "permission denied")
+	assert.ErrorIs(t, err, os.ErrPermission)
+}
+
+func TestHashFiles(t *testing.T) {
+	dir := t.TempDir()
+	var fnames []string
+	for i := 0; i < 50; i++ {
+		fname := filepath.Join(dir, fmt.Sprintf("file%d.txt", i))
+		assert.Nil(t, os.WriteFile(fname, []byte(fmt.Sprintf("content %d", i)), 0o644))
+		fnames = append(fnames, fname)
+	}
+	hashes, err := HashFiles(fnames, "md5", 4)
+	assert.Nil(t, err)
+	assert.Len(t, hashes, len(fnames))
+	for i, fname := range fnames {
+		sum := md5.Sum([]byte(fmt.Sprintf("content %d", i)))
+		assert.Equal(t, sum[:], hashes[fname])
+	}
+
+	hashes, err = HashFiles(fnames[:3], "xxhash", 0)
+	assert.Nil(t, err)
+	assert.Len(t, hashes, 3)
+
+	_, err = HashFiles(append(fnames, filepath.Join(dir, "missing")), "md5", 4)
+	assert.True(t, os.IsNotExist(err))
+}
+
+type recordingReporter struct {
+	calls int
+	total int
+}
+
+func (r *recordingReporter) Add(n int) error {
+	r.calls++
+	r.total += n
+	return nil
+}
+
+func TestBudgetWriter(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewBudgetWriter(&buf, 10)
+	assert.Equal(t, int64(10), w.Remaining())
+	n, err := w.Write([]byte("hello"))
+	assert.Nil(t, err)
+	assert.Equal(t, 5, n)
+	assert.Equal(t, int64(5), w.Remaining())
+
+	n, err = w.Write([]byte(" world"))
+	assert.ErrorIs(t, err, ErrBudgetExceeded)
+	assert.Equal(t, 5, n)
+	assert.Equal(t, "hello worl", buf.String())
+	assert.Equal(t, int64(0), w.Remaining())
+
+	n, err = w.Write([]byte("!"))
+	assert.ErrorIs(t, err, ErrBudgetExceeded)
+	assert.Equal(t, 0, n)
+	n, err = w.Write(nil)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, n)
+
+	// io.Copy stops at the budget
+	buf.Reset()
+	copied, err := io.Copy(NewBudgetWriter(&buf, 1000), bytes.NewReader(make([]byte, 5000)))
+	assert.ErrorIs(t, err, ErrBudgetExceeded)
+	assert.Equal(t, int64(1000), copied)
+	assert.Equal(t, 1000, buf.Len())
+}
+
+func TestThrottledReporter(t *testing.T) {
+	underlying := &recordingReporter{}
+	interval := 20 * time.Millisecond
+	throttled := NewThrottledReporter(underlying, interval)
+	start := time.Now()
+	for i := 0; i < 100000; i++ {
+		assert.Nil(t, throttled.Add(1))
+	}
+	elapsed := time.Since(start)
+	// one refresh right away, then at most one per interval
+	assert.LessOrEqual(t, underlying.calls, 1+int(elapsed/interval))
+	assert.Nil(t, throttled.Flush())
+	assert.Equal(t, 100000, underlying.total)
+
+	assert.Equal(t, defaultRefreshInterval, NewThrottledReporter(underlying, 0).interval)
+}
+
+func TestHashFileTyped(t *testing.T) {
+	bigFile()
+	defer os.Remove("bigfile.test")
+	fileHash, err := HashFileTyped("bigfile.test", "xxhash")
+	assert.Nil(t, err)
+	assert.Equal(t, "xxhash", fileHash.Algorithm)
+	assert.Equal(t, "4918740eb5ccb6f7", fmt.Sprintf("%x", fileHash.Sum))
+
+	_, err = HashFileTyped("bigfile.test", "nope")
+	assert.NotNil(t, err)
+}
+
+func TestIsCaseInsensitiveFS(t *testing.T) {
+	dir := t.TempDir()
+	insensitive, err := IsCaseInsensitiveFS(dir)
+	assert.Nil(t, err)
+	if runtime.GOOS == "linux" {
+		assert.False(t, insensitive)
+	}
+	entries, err := os.ReadDir(dir)
+	assert.Nil(t, err)
+	assert.Empty(t, entries)
+
+	_, err = IsCaseInsensitiveFS(filepath.Join(dir, "missing"))
+	assert.NotNil(t, err)
+}
+
+type failingReader struct{}
+
+func (failingReader) Read(p []byte) (int, error) {
+	return 0, fmt.Errorf("broken pipe")
+}
+
+func TestTeeStdinToFile(t *testing.T) {
+	defer func(original io.Reader) { stdin = original }(stdin)
+	content := make([]byte, 100000)
+	rand.Read(content)
+	stdin = bytes.NewReader(content)
+	dest := filepath.Join(t.TempDir(), "stdin.bin")
+
+	digest, size, err := TeeStdinToFile(dest, "md5")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(len(content)), size)
+	saved, err := os.ReadFile(dest)
+	assert.Nil(t, err)
+	assert.Equal(t, content, saved)
+	sum := md5.Sum(content)
+	assert.Equal(t, sum[:], digest)
+	fileHash, err := HashFile(dest, "md5")
+	assert.Nil(t, err)
+	assert.Equal(t, fileHash, digest)
+
+	// a failed copy leaves nothing behind
+	stdin = io.MultiReader(bytes.NewReader(content), failingReader{})
+	failed := filepath.Join(t.TempDir(), "failed.bin")
+	_, _, err = TeeStdinToFile(failed, "md5")
+	assert.NotNil(t, err)
+	entries, err := os.ReadDir(filepath.Dir(failed))
+	assert.Nil(t, err)
+	assert.Empty(t, entries)
+}
+
+func TestFindDuplicates(t *testing.T) {
+	root := t.TempDir()
+	assert.Nil(t, os.MkdirAll(filepath.Join(root, "sub"), 0o755))
+	big := make([]byte, 3*1024*1024)
+	rand.Read(big)
+	// same size and same imohash samples but different content
+	bigVariant := append([]byte{}, big...)
+	bigVariant[len(big)/4] ^= 0xff
+	files := map[string][]byte{
+		"a.txt":          []byte("hello"),
+		"sub/a copy.txt": []byte("hello"),
+		"b.txt":          []byte("world"),
+		"big.bin":        big,
+		"sub/big.bin":    big,
+		"variant.bin":    bigVariant,
+	}
+	for name, content := range files {
+		assert.Nil(t, os.WriteFile(filepath.Join(root, name), content, 0o644))
+	}
+
+	duplicates, err := FindDuplicates(root, "xxhash")
+	assert.Nil(t, err)
+	helloHash, err := HashFile(filepath.Join(root, "a.txt"), "xxhash")
+	assert.Nil(t, err)
+	bigHash, err := HashFile(filepath.Join(root, "big.bin"), "xxhash")
+	assert.Nil(t, err)
+	assert.Equal(t, map[string][]string{
+		fmt.Sprintf("%x", helloHash): {filepath.Join(root, "a.txt"), filepath.Join(root, "sub", "a copy.txt")},
+		fmt.Sprintf("%x", bigHash):   {filepath.Join(root, "big.bin"), filepath.Join(root, "sub", "big.bin")},
+	}, duplicates)
+}
+
+func TestResolveWithinRoot(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("creating symlinks needs privileges on windows")
+	}
+	root, err := filepath.EvalSymlinks(t.TempDir())
+	assert.Nil(t, err)
+	assert.Nil(t, os.MkdirAll(filepath.Join(root, "a", "b"), 0o755))
+	assert.Nil(t, os.WriteFile(filepath.Join(root, "file.txt"), []byte("x"), 0o644))
+	inside := filepath.Join(root, "a", "b", "inside")
+	assert.Nil(t, os.Symlink("../../file.txt", inside))
+	outside := filepath.Join(root, "a", "b", "outside")
+	assert.Nil(t, os.Symlink("../../../../../../../../etc/passwd", outside))
+
+	target, err := ResolveWithinRoot(root, inside)
+	assert.Nil(t, err)
+	assert.Equal(t, filepath.Join(root, "file.txt"), target)
+
+	if _, errStat := os.Stat("/etc/passwd"); errStat == nil {
+		target, err = ResolveWithinRoot(root, outside)
+		assert.ErrorIs(t, err, ErrOutsideRoot)
+		assert.Empty(t, target)
+	}
+	_, err = ResolveWithinRoot(filepath.Join(root, "a"), filepath.Join(root, "a", "b", "inside"))
+	assert.ErrorIs(t, err, ErrOutsideRoot)
+}
+
+func TestBinaryDiff(t *testing.T) {
+	dir := t.TempDir()
+	oldContent := make([]byte, 200*1024+123)
+	rand.Read(oldContent)
+	// insert, modify and drop some bytes
+	newContent := append([]byte{}, oldContent[:50000]...)
+	newContent = append(newContent, []byte("some inserted bytes")...)
+	newContent = append(newContent, oldContent[50000:120000]...)
+	modified := make([]byte, 3000)
+	rand.Read(modified)
+	newContent = append(newContent, modified...)
+	newContent = append(newContent, oldContent[123000:190000]...)
+	oldFname := filepath.Join(dir, "old.bin")
+	newFname := filepath.Join(dir, "new.bin")
+	assert.Nil(t, os.WriteFile(oldFname, oldContent, 0o644))
+	assert.Nil(t, os.WriteFile(newFname, newContent, 0o644))
+
+	patch, err := BinaryDiff(oldFname, newFname)
+	assert.Nil(t, err)
+	assert.Less(t, len(patch), len(newContent)/10)
+	outFname := filepath.Join(dir, "out.bin")
+	assert.Nil(t, ApplyBinaryDiff(oldFname, patch, outFname))
+	out, err := os.ReadFile(outFname)
+	assert.Nil(t, err)
+	assert.Equal(t, newContent, out)
+
+	// nothing in common
+	emptyFname := filepath.Join(dir, "empty.bin")
+	assert.Nil(t, os.WriteFile(emptyFname, nil, 0o644))
+	patch, err = BinaryDiff(emptyFname, newFname)
+	assert.Nil(t, err)
+	assert.Nil(t, ApplyBinaryDiff(emptyFname, patch, outFname))
+	out, err = os.ReadFile(outFname)
+	assert.Nil(t, err)
+	assert.Equal(t, newContent, out)
+
+	// the patch doesn't apply to another file
+	patch, err = BinaryDiff(oldFname, newFname)
+	assert.Nil(t, err)
+	assert.NotNil(t, ApplyBinaryDiff(newFname, patch, filepath.Join(dir, "bad.bin")))
+	_, err = os.Stat(filepath.Join(dir, "bad.bin"))
+	assert.True(t, os.IsNotExist(err))
+	assert.NotNil(t, ApplyBinaryDiff(oldFname, patch[:len(patch)/2], filepath.Join(dir, "bad.bin")))
+	assert.NotNil(t, ApplyBinaryDiff(oldFname, []byte("nope"), filepath.Join(dir, "bad.bin")))
+
+	// a patch copying more than it declares is stopped before writing it
+	for _, op := range [][]byte{
+		binary.AppendUvarint([]byte{'c', 0}, uint64(len(oldContent))),
+		append([]byte{'l', 20}, make([]byte, 20)...),
+	} {
+		patch = binary.AppendUvarint([]byte(binaryDiffMagic), 10)
+		patch = binary.BigEndian.AppendUint64(patch, 0)
+		for range 1000 {
+			patch = append(patch, op...)
+		}
+		assert.ErrorIs(t, ApplyBinaryDiff(oldFname, patch, filepath.Join(dir, "bad.bin")), errPatchTooLong)
+	}
+	entries, err := os.ReadDir(dir)
+	assert.Nil(t, err)
+	assert.Len(t, entries, 4)
+}
+
+func TestHashFileProgress(t *testing.T) {
+	bigFile()
+	defer os.Remove("bigfile.test")
+	stat, err := os.Stat("bigfile.test")
+	assert.Nil(t, err)
+	for _, algorithm := range []string{"xxhash", "imohash"} {
+		var calls int
+		var lastDone, lastTotal int64
+		b, err := HashFileProgress("bigfile.test", algorithm, func(done, total int64) {
+			assert.GreaterOrEqual(t, done, lastDone)
+			calls++
+			lastDone, lastTotal = done, total
+		})
+		assert.Nil(t, err)
+		expected, err := HashFile("bigfile.test", algorithm)
+		assert.Nil(t, err)
+		assert.Equal(t, expected, b)
+		assert.Greater(t, calls, 0)
+		assert.Equal(t, stat.Size(), lastDone)
+		assert.Equal(t, stat.Size(), lastTotal)
+	}
+}
+
+func TestValidateChunkRanges(t *testing.T) {
+	valid := []int64{10, 0, 1, 40, 2, 70, 3}
+	assert.Nil(t, ValidateChunkRanges(valid, 100))
+	assert.Nil(t, ValidateChunkRanges(valid, 95))
+	assert.Nil(t, ValidateChunkRanges(nil, 100))
+	assert.Equal(t, []int64{0, 40, 50, 70, 80, 90}, ChunkRangesToChunks(valid, 100))
+
+	// a malicious peer claiming an enormous number of chunks
+	malicious := []int64{1, 0, 1 << 40}
+	assert.NotNil(t, ValidateChunkRanges(malicious, 100))
+	allocs := testing.AllocsPerRun(1, func() {
+		assert.Nil(t, ChunkRangesToChunks(malicious, 100))
+	})
+	assert.Less(t, allocs, float64(100))
+
+	assert.NotNil(t, ValidateChunkRanges([]int64{10, 0}, 100))
+	assert.NotNil(t, ValidateChunkRanges([]int64{0, 0, 1}, 100))
+	assert.NotNil(t, ValidateChunkRanges([]int64{10, -10, 1}, 100))
+	assert.NotNil(t, ValidateChunkRanges([]int64{10, 100, 1}, 100))
+	assert.NotNil(t, ValidateChunkRanges([]int64{10, 90, 2}, 100))
+	assert.NotNil(t, ValidateChunkRanges([]int64{10, 0, 10, 0, 10}, 100))
+}
+
+func TestZeroFillRatio(t *testing.T) {
+	chunkSize := 10
+	content := make([]byte, 100)
+	rand.Read(content)
+	// 3 of the 10 chunks are zeros, another one only partially
+	copy(content[0:10], make([]byte, 10))
+	copy(content[50:70], make([]byte, 20))
+	copy(content[80:85], make([]byte, 5))
+	fname := filepath.Join(t.TempDir(), "zeros.test")
+	assert.Nil(t, os.WriteFile(fname, content, 0o644))
+	ratio, err := ZeroFillRatio(fname, chunkSize)
+	assert.Nil(t, err)
+	assert.InDelta(t, 0.3, ratio, 1e-9)
+
+	// the last partial chunk counts as a chunk
+	assert.Nil(t, os.WriteFile(fname, make([]byte, 15), 0o644))
+	ratio, err = ZeroFillRatio(fname, chunkSize)
+	assert.Nil(t, err)
+	assert.InDelta(t, 1, ratio, 1e-9)
+
+	assert.Nil(t, os.WriteFile(fname, nil, 0o644))
+	ratio, err = ZeroFillRatio(fname, chunkSize)
+	assert.Nil(t, err)
+	assert.Zero(t, ratio)
+
+	_, err = ZeroFillRatio(fname, 0)
+	assert.NotNil(t, err)
+}
+
+func TestConfirmationWords(t *testing.T) {
+	key := []byte("a session key agreed with pake")
+	words := ConfirmationWords(key, 2)
+	assert.Len(t, words, 2)
+	assert.Equal(t, words, ConfirmationWords(key, 2))
+	assert.NotEqual(t, words, ConfirmationWords([]byte("another session key"), 2))
+	for _, n := range []int{1, 3, 4, 7} {
+		more := ConfirmationWords(key, n)
+		assert.Len(t, more, n)
+		for _, word := range more {
+			assert.NotEmpty(t, word)
+		}
+	}
+	assert.Empty(t, ConfirmationWords(key, 0))
+	assert.Len(t, ConfirmationWords(key, MaxConfirmationWords), MaxConfirmationWords)
+	assert.Len(t, ConfirmationWords(key, 10000), MaxConfirmationWords)
+}
+
+func TestMeasureWriteSpeed(t *testing.T) {
+	dir := t.TempDir()
+	speed, err := MeasureWriteSpeed(dir, 3*1024*1024+5)
+	assert.Nil(t, err)
+	assert.Greater(t, speed, float64(0))
+	entries, err := os.ReadDir(dir)
+	assert.Nil(t, err)
+	assert.Empty(t, entries)
+
+	_, err = MeasureWriteSpeed(dir, 0)
+	assert.NotNil(t, err)
+	_, err = MeasureWriteSpeed(filepath.Join(dir, "missing"), 1024)
+	assert.NotNil(t, err)
+}
+
+func TestClassifyCode(t *testing.T) {
+	for i := 0; i < 20; i++ {
+		code := GetRandomName()
+		assert.Equal(t, CodeGenerated, ClassifyCode(code), code)
+	}
+	assert.Equal(t, CodeGenerated, ClassifyCode(" 1234 Apple River "))
+	assert.Equal(t, CodeCustom, ClassifyCode("mysecret"))
+	assert.Equal(t, CodeCustom, ClassifyCode("1234-mysecret"))
+	assert.Equal(t, CodeCustom, ClassifyCode("12a4-apple-river"))
+	assert.Equal(t, CodeCustom, ClassifyCode("123-apple-river"))
+	assert.Equal(t, CodeInvalid, ClassifyCode(""))
+	assert.Equal(t, CodeInvalid, ClassifyCode("   "))
+	assert.Equal(t, CodeInvalid, ClassifyCode("1234-apple\x00river"))
+	assert.Equal(t, CodeInvalid, ClassifyCode("my\nsecret"))
+}
+
+func TestValidateCodeAgainstWordlistVersion(t *testing.T) {
+	version := WordlistVersion()
+	assert.Len(t, version, 16)
+	code := GetRandomName()
+	assert.Nil(t, ValidateCodeAgainstWordlistVersion(code, version))
+	assert.NotNil(t, ValidateCodeAgainstWordlistVersion("1234-not-real-wordz", version))
+
+	// saved by a croc bundling another wordlist
+	err := ValidateCodeAgainstWordlistVersion(code, "0123456789abcdef")
+	assert.ErrorIs(t, err, ErrWordlistMismatch)
+	assert.Contains(t, err.Error(), "different wordlist")
+}
+
+func TestResumeOffset(t *testing.T) {
+	fname := filepath.Join(t.TempDir(), "partial.test")
+	offset, err := ResumeOffset(fname, 100)
+	assert.Nil(t, err)
+	assert.Zero(t, offset)
+
+	assert.Nil(t, os.WriteFile(fname, make([]byte, 40), 0o644))
+	offset, err = ResumeOffset(fname, 100)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(40), offset)
+
+	// complete, nothing left to fetch
+	offset, err = ResumeOffset(fname, 40)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(40), offset)
+
+	_, err = ResumeOffset(fname, 30)
+	assert.NotNil(t, err)
+}
+
+func TestSanitizeZipEntry(t *testing.T) {
+	name, mode, err := SanitizeZipEntry("/etc/passwd", 0o644)
+	assert.Nil(t, err)
+	assert.Equal(t, "etc/passwd", name)
+	assert.Equal(t, os.FileMode(0o644), mode)
+
+	// the Windows rules only apply on Windows
+	for _, tc := range []struct {
+		name, goos, expected string
+	}{
+		{`C:\Windows\con.txt`, "windows", "Windows/_con.txt"},
+		{`C:\Windows\con.txt`, "linux", `C:\Windows\con.txt`},
+		{`dir/a\b?. `, "windows", "dir/a/b_"},
+		{`dir/a\b?. `, "darwin", `dir/a\b?. `},
+		{"dir/nul/con.txt", "linux", "dir/nul/con.txt"},
+		{"dir/bell\a", "linux", "dir/bell_"},
+	} {
+		name, _, err = sanitizeZipEntryForOS(tc.name, 0o644, tc.goos)
+		assert.Nil(t, err)
+		assert.Equal(t, tc.expected, name, "%s on %s", tc.name, tc.goos)
+	}
+
+	for _, goos := range []string{"windows", "linux"} {
+		for _, evil := range []string{"../../evil.sh", `dir\..\..\evil.sh`, "/"} {
+			_, _, err = sanitizeZipEntryForOS(evil, 0o755, goos)
+			assert.NotNil(t, err, "%s on %s", evil, goos)
+		}
+	}
+
+	name, mode, err = SanitizeZipEntry("bin/tool", 0o755|os.ModeSetuid|os.ModeSetgid|os.ModeSticky)
+	assert.Nil(t, err)
+	assert.Equal(t, "bin/tool", name)
+	assert.Equal(t, os.FileMode(0o755), mode)
+
+	// a malicious archive extracts safely
+	dir := t.TempDir()
+	fname := filepath.Join(dir, "malicious.zip")
+	f, err := os.Create(fname)
+	assert.Nil(t, err)
+	writer := zip.NewWriter(f)
+	for _, entry := range []struct {
+		name string
+		mode os.FileMode
+	}{
+		{"/abs/file.txt", 0o644},
+		{"../../evil.txt", 0o644},
+		{"bin/tool", 0o755 | os.ModeSetuid},
+	} {
+		header := &zip.FileHeader{Name: entry.name, Method: zip.Store}
+		header.SetMode(entry.mode)
+		w, err := writer.CreateHeader(header)
+		assert.Nil(t, err)
+		w.Write([]byte("content"))
+	}
+	assert.Nil(t, writer.Close())
+	assert.Nil(t, f.Close())
+
+	dest := filepath.Join(dir, "a", "b", "dest")
+	assert.Nil(t, os.MkdirAll(dest, 0o755))
+	assert.Nil(t, UnzipDirectory(dest, fname))
+	_, err = os.Stat(filepath.Join(dest, "abs", "file.txt"))
+	assert.Nil(t, err)
+	for _, evil := range []string{filepath.Join(dir, "a", "evil.txt"), filepath.Join(dest, "evil.txt")} {
+		_, err = os.Stat(evil)
+		assert.True(t, os.IsNotExist(err))
+	}
+	stat, err := os.Stat(filepath.Join(dest, "bin", "tool"))
+	assert.Nil(t, err)
+	assert.Zero(t, stat.Mode()&os.ModeSetuid)
+}
+
+func TestCopyFilesWithProgress(t *testing.T) {
+	src := t.TempDir()
+	dst := t.TempDir()
+	var pairs []CopyPair
+	var total int64
+	for i, size := range []int{0, 10, 100000, 3 * 1024 * 1024} {
+		content := make([]byte, size)
+		rand.Read(content)
+		fname := filepath.Join(src, fmt.Sprintf("file%d", i))
+		assert.Nil(t, os.WriteFile(fname, content, 0o644))
+		pairs = append(pairs, CopyPair{Src: fname, Dst: filepath.Join(dst, "sub", fmt.Sprintf("file%d", i))})
+		total += int64(size)
+	}
+
+	var lastDone int64
+	err := CopyFilesWithProgress(pairs, func(done, cbTotal int64) {
+		assert.GreaterOrEqual(t, done, lastDone)
+		assert.Equal(t, total, cbTotal)
+		lastDone = done
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, total, lastDone)
+	for _, pair := range pairs {
+		expected, err := os.ReadFile(pair.Src)
+		assert.Nil(t, err)
+		copied, err := os.ReadFile(pair.Dst)
+		assert.Nil(t, err)
+		assert.Equal(t, expected, copied)
+	}
+
+	missing := filepath.Join(src, "missing")
+	err = CopyFilesWithProgress(append(pairs, CopyPair{Src: missing, Dst: filepath.Join(dst, "missing")}), func(done, total int64) {})
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), missing)
+}
+
+func TestRecommendConnectionCount(t *testing.T) {
+	tests := []struct {
+		bandwidth float64
+		rtt       float64
+		expected  int
+	}{
+		{1e6, 10, 1},       // slow LAN
+		{10e6, 20, 1},      // 200 kB in flight
+		{10e6, 100, 4},     // 1 MB in flight
+		{100e6, 50, 16},    // 5 MB in flight, clamped
+		{1e9, 300, 16},     // clamped
+		{0, 50, 1},         // unknown bandwidth
+		{10e6, 0, 1},       // unknown rtt
+		{math.NaN(), 1, 1}, // garbage
+	}
+	for _, tt := range tests {
+		n := RecommendConnectionCount(tt.bandwidth, tt.rtt)
+		assert.Equal(t, tt.expected, n, "%v B/s %v ms", tt.bandwidth, tt.rtt)
+		assert.GreaterOrEqual(t, n, 1)
+		assert.LessOrEqual(t, n, 16)
+	}
+
+	// more latency needs more connections for the same bandwidth
+	previous := 0
+	for rtt := 1.0; rtt <= 1000; rtt *= 2 {
+		n := RecommendConnectionCount(20e6, rtt)
+		assert.GreaterOrEqual(t, n, previous)
+		previous = n
+	}
+	assert.Greater(t, previous, 1)
+}
@@ -0,0 +1,68 @@
+//go:build !windows
+// +build !windows
+
+package utils
+
+import (
+	"fmt"
+	"math"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// lockFile blocks until it holds an exclusive lock on f
+func lockFile(f *os.File) error {
+	for {
+		err := unix.Flock(int(f.Fd()), unix.LOCK_EX)
+		if err != unix.EINTR {
+			return err
+		}
+	}
+}
+
+// unlockFile releases the lock held on f
+func unlockFile(f *os.File) error {
+	return unix.Flock(int(f.Fd()), unix.LOCK_UN)
+}
+
+// mmapFile maps the first size bytes of f into memory read-only. Reading
+// pages past the end of f, if it is truncated meanwhile, raises SIGBUS.
+func mmapFile(f *os.File, size int64) (data []byte, unmap func() error, err error) {
+	if size <= 0 || size > math.MaxInt {
+		return nil, nil, fmt.Errorf("cannot map %d bytes", size)
+	}
+	data, err = unix.Mmap(int(f.Fd()), 0, int(size), unix.PROT_READ, unix.MAP_SHARED)
+	if err != nil {
+		return
+	}
+	unmap = func() error {
+		return unix.Munmap(data)
+	}
+	return
+}
+
+// blockSize returns the block size of the filesystem holding path
+func blockSize(path string) (size int64, err error) {
+	var stat unix.Statfs_t
+	if err = unix.Statfs(path, &stat); err != nil {
+		return
+	}
+	return int64(stat.Bsize), nil
+}
+
+// defaultMaxOpenFiles returns half of the soft limit on open files, leaving
+// the rest to the connections and files of the transfer itself
+func defaultMaxOpenFiles() int {
+	var rlimit unix.Rlimit
+	if err := unix.Getrlimit(unix.RLIMIT_NOFILE, &rlimit); err != nil {
+		return 128
+	}
+	limit := uint64(rlimit.Cur) / 2
+	if limit < 1 {
+		limit = 1
+	} else if limit > 4096 {
+		limit = 4096
+	}
+	return int(limit)
+}
@@ -0,0 +1,47 @@
+package utils
+
+import (
+	"fmt"
+	"os"
+
+	"golang.org/x/sys/windows"
+)
+
+// lockFile blocks until it holds an exclusive lock on f
+func lockFile(f *os.File) error {
+	ol := new(windows.Overlapped)
+	return windows.LockFileEx(windows.Handle(f.Fd()), windows.LOCKFILE_EXCLUSIVE_LOCK, 0, 1, 0, ol)
+}
+
+// unlockFile releases the lock held on f
+func unlockFile(f *os.File) error {
+	ol := new(windows.Overlapped)
+	return windows.UnlockFileEx(windows.Handle(f.Fd()), 0, 1, 0, ol)
+}
+
+// mmapFile is not supported on Windows
+func mmapFile(f *os.File, size int64) (data []byte, unmap func() error, err error) {
+	return nil, nil, fmt.Errorf("mmap is not supported on windows")
+}
+
+// blockSize is unknown on Windows
+func blockSize(path string) (size int64, err error) {
+	return 0, nil
+}
+
+// defaultMaxOpenFiles returns a conservative number of concurrently open
+// files, as Windows has no per-process soft limit to query
+func defaultMaxOpenFiles() int {
+	return 512
+}
+
+// preallocate reserves size bytes on disk for f by moving the end of file,
+// which allocates the space without writing zeros
+func preallocate(f *os.File, size int64) error {
+	h := windows.Handle(f.Fd())
+	high := int32(size >> 32)
+	if _, err := windows.SetFilePointer(h, int32(size), &high, windows.FILE_BEGIN); err != nil {
+		return err
+	}
+	return windows.SetEndOfFile(h)
+}